@@ -0,0 +1,381 @@
+package zindexer
+
+import (
+	"fmt"
+	"github.com/Zondax/zindexer/components/tracker"
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+	"io"
+	"time"
+)
+
+type DBConnectionHandler func() (*gorm.DB, error)
+
+type trackerCmdParams struct {
+	id        string
+	dataType  string
+	from      uint64
+	to        uint64
+	genesis   uint64
+	tip       uint64
+	reconcile tracker.ReconcileConfig
+	dbHandler DBConnectionHandler
+}
+
+// NewTrackerCommand returns the 'tracker' command group, ready to be mounted on any indexer root command.
+// The handler is called lazily to get the database connection holding the tracking table
+func NewTrackerCommand(id string, handler DBConnectionHandler) *cobra.Command {
+	p := &trackerCmdParams{dbHandler: handler}
+
+	trackerCmd := &cobra.Command{
+		Use:   "tracker",
+		Short: "Inspect and fix the heights tracked by this indexer",
+	}
+	trackerCmd.PersistentFlags().StringVar(&p.id, "id", id, "The tracker id to operate on")
+	trackerCmd.PersistentFlags().StringVar(&p.dataType, "data-type", "", "The data type sub-tracker to operate on. Defaults to the indexer tracker")
+
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Show tracked sections",
+		Args:  cobra.NoArgs,
+		RunE:  p.runShow,
+	}
+
+	wipCmd := &cobra.Command{
+		Use:   "wip",
+		Short: "Show in-progress leases with their owner and expiry",
+		Args:  cobra.NoArgs,
+		RunE:  p.runWip,
+	}
+
+	gapsCmd := &cobra.Command{
+		Use:   "gaps",
+		Short: "Show untracked sections between genesis and tip",
+		Args:  cobra.NoArgs,
+		RunE:  p.runGaps,
+	}
+	gapsCmd.Flags().Uint64Var(&p.genesis, "genesis", 0, "The genesis height")
+	gapsCmd.Flags().Uint64Var(&p.tip, "tip", 0, "The chain tip height. Defaults to the tracked tip")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove the section [from, to] from the tracked heights",
+		Args:  cobra.NoArgs,
+		RunE:  p.runRemove,
+	}
+	addRangeFlags(removeCmd, p)
+
+	markCmd := &cobra.Command{
+		Use:   "mark",
+		Short: "Mark the section [from, to] as tracked",
+		Args:  cobra.NoArgs,
+		RunE:  p.runMark,
+	}
+	addRangeFlags(markCmd, p)
+
+	clearWipCmd := &cobra.Command{
+		Use:   "clear-wip",
+		Short: "Clear all in-progress heights",
+		Args:  cobra.NoArgs,
+		RunE:  p.runClearWip,
+	}
+
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Compare the tracked heights with the heights present in a table",
+		Args:  cobra.NoArgs,
+		RunE:  p.runReconcile,
+	}
+	reconcileCmd.Flags().StringVar(&p.reconcile.Table, "table", "", "The table holding the indexed data")
+	reconcileCmd.Flags().StringVar(&p.reconcile.HeightColumn, "column", "height", "The height column of the table")
+	reconcileCmd.Flags().Uint64Var(&p.reconcile.From, "from", 0, "First height to reconcile. Defaults to all heights")
+	reconcileCmd.Flags().Uint64Var(&p.reconcile.To, "to", 0, "Last height to reconcile (inclusive)")
+	reconcileCmd.Flags().BoolVar(&p.reconcile.Repair, "repair", false, "Update the tracker to match the table")
+	_ = reconcileCmd.MarkFlagRequired("table")
+
+	renameCmd := &cobra.Command{
+		Use:   "rename <new-id>",
+		Short: "Move all tracked sections of the tracker id to a new, untracked id",
+		Args:  cobra.ExactArgs(1),
+		RunE:  p.runRename,
+	}
+
+	copyCmd := &cobra.Command{
+		Use:   "copy <new-id>",
+		Short: "Copy all tracked sections of the tracker id to a new, untracked id",
+		Args:  cobra.ExactArgs(1),
+		RunE:  p.runCopy,
+	}
+
+	mergeCmd := &cobra.Command{
+		Use:   "merge <into-id>",
+		Short: "Add all tracked sections of the tracker id to another id",
+		Args:  cobra.ExactArgs(1),
+		RunE:  p.runMerge,
+	}
+
+	diffCmd := &cobra.Command{
+		Use:   "diff <other-id>",
+		Short: "Show the sections tracked by only one of the tracker id and another id",
+		Args:  cobra.ExactArgs(1),
+		RunE:  p.runDiff,
+	}
+
+	trackerCmd.AddCommand(showCmd, wipCmd, gapsCmd, removeCmd, markCmd, clearWipCmd, reconcileCmd,
+		renameCmd, copyCmd, mergeCmd, diffCmd)
+	return trackerCmd
+}
+
+func addRangeFlags(c *cobra.Command, p *trackerCmdParams) {
+	c.Flags().Uint64Var(&p.from, "from", 0, "First height of the section (inclusive)")
+	c.Flags().Uint64Var(&p.to, "to", 0, "Last height of the section (inclusive)")
+	_ = c.MarkFlagRequired("from")
+	_ = c.MarkFlagRequired("to")
+}
+
+func (p *trackerCmdParams) getDB() (*gorm.DB, error) {
+	if p.dbHandler == nil {
+		return nil, fmt.Errorf("no database connection handler defined")
+	}
+
+	return p.dbHandler()
+}
+
+func (p *trackerCmdParams) getSections(db *gorm.DB) (tracker.Sections, error) {
+	if p.dataType != "" {
+		return tracker.GetSectionsForType(p.id, p.dataType, db)
+	}
+
+	return tracker.GetSections(p.id, db)
+}
+
+func (p *trackerCmdParams) getRange() (tracker.Section, error) {
+	if p.from > p.to {
+		return tracker.Section{}, fmt.Errorf("invalid range: 'from' (%d) is greater than 'to' (%d)", p.from, p.to)
+	}
+
+	return tracker.Section{StartIdx: p.from, EndIdx: p.to}, nil
+}
+
+func (p *trackerCmdParams) runShow(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	sections, err := p.getSections(db)
+	if err != nil {
+		return err
+	}
+
+	printSections(c.OutOrStdout(), sections)
+	return nil
+}
+
+func (p *trackerCmdParams) runWip(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	leases, err := tracker.GetLeases(p.id, db)
+	if err != nil {
+		return err
+	}
+
+	out := c.OutOrStdout()
+	for _, l := range leases {
+		expiresAt := "never"
+		if l.ExpiresAt != nil {
+			expiresAt = l.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "[%d, %d]\t%d\towner: %s\texpires: %s\n", l.StartIdx, l.EndIdx, l.EndIdx-l.StartIdx+1, l.Owner, expiresAt)
+	}
+
+	fmt.Fprintf(out, "leases: %d\n", len(leases))
+	return nil
+}
+
+func (p *trackerCmdParams) runGaps(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	sections, err := p.getSections(db)
+	if err != nil {
+		return err
+	}
+
+	tip := p.tip
+	if tip == 0 && len(sections) > 0 {
+		tip = sections[len(sections)-1].EndIdx
+	}
+
+	sections = append(sections,
+		tracker.Section{StartIdx: p.genesis, EndIdx: p.genesis},
+		tracker.Section{StartIdx: tip, EndIdx: tip},
+	)
+
+	printSections(c.OutOrStdout(), tracker.FindGapSections(sections))
+	return nil
+}
+
+func (p *trackerCmdParams) runRemove(c *cobra.Command, args []string) error {
+	section, err := p.getRange()
+	if err != nil {
+		return err
+	}
+
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	if p.dataType != "" {
+		err = tracker.RemoveSectionsForType(tracker.Sections{section}, p.id, p.dataType, db)
+	} else {
+		err = tracker.RemoveSectionsFromTracker(tracker.Sections{section}, p.id, db)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.OutOrStdout(), "removed [%d, %d] from tracker '%s'\n", section.StartIdx, section.EndIdx, p.id)
+	return nil
+}
+
+func (p *trackerCmdParams) runMark(c *cobra.Command, args []string) error {
+	section, err := p.getRange()
+	if err != nil {
+		return err
+	}
+
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	if p.dataType != "" {
+		err = tracker.UpdateTrackedSectionsForType(tracker.Sections{section}, p.id, p.dataType, db)
+	} else {
+		err = tracker.UpdateTrackedSections(tracker.Sections{section}, p.id, db)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.OutOrStdout(), "marked [%d, %d] as tracked for tracker '%s'\n", section.StartIdx, section.EndIdx, p.id)
+	return nil
+}
+
+func (p *trackerCmdParams) runClearWip(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	err = tracker.ClearInProgress(p.id, db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.OutOrStdout(), "cleared in-progress heights for tracker '%s'\n", p.id)
+	return nil
+}
+
+func (p *trackerCmdParams) runReconcile(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	p.reconcile.DataType = p.dataType
+	report, err := tracker.Reconcile(p.id, p.reconcile, db)
+	if err != nil {
+		return err
+	}
+
+	out := c.OutOrStdout()
+	fmt.Fprintln(out, "tracked without data:")
+	printSections(out, report.TrackedWithoutData)
+	fmt.Fprintln(out, "data without tracking:")
+	printSections(out, report.DataWithoutTracking)
+	if report.Repaired {
+		fmt.Fprintf(out, "tracker '%s' repaired\n", p.id)
+	}
+
+	return nil
+}
+
+func (p *trackerCmdParams) runRename(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	if err = tracker.RenameTracker(p.id, args[0], db); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.OutOrStdout(), "renamed tracker '%s' to '%s'\n", p.id, args[0])
+	return nil
+}
+
+func (p *trackerCmdParams) runCopy(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	if err = tracker.CopyTracker(p.id, args[0], db); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.OutOrStdout(), "copied tracker '%s' to '%s'\n", p.id, args[0])
+	return nil
+}
+
+func (p *trackerCmdParams) runMerge(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	if err = tracker.MergeTrackers(p.id, args[0], db); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.OutOrStdout(), "merged tracker '%s' into '%s'\n", p.id, args[0])
+	return nil
+}
+
+func (p *trackerCmdParams) runDiff(c *cobra.Command, args []string) error {
+	db, err := p.getDB()
+	if err != nil {
+		return err
+	}
+
+	onlyThis, onlyOther, err := tracker.DiffTrackers(p.id, args[0], db)
+	if err != nil {
+		return err
+	}
+
+	out := c.OutOrStdout()
+	fmt.Fprintf(out, "only in '%s':\n", p.id)
+	printSections(out, onlyThis)
+	fmt.Fprintf(out, "only in '%s':\n", args[0])
+	printSections(out, onlyOther)
+	return nil
+}
+
+func printSections(w io.Writer, sections tracker.Sections) {
+	var total uint64
+	for _, s := range sections {
+		count := s.EndIdx - s.StartIdx + 1
+		total += count
+		fmt.Fprintf(w, "[%d, %d]\t%d\n", s.StartIdx, s.EndIdx, count)
+	}
+
+	fmt.Fprintf(w, "sections: %d, heights: %d\n", len(sections), total)
+}
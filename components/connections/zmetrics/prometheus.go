@@ -16,9 +16,11 @@ type GaugeOpts prometheus.GaugeOpts
 type HistogramOpts prometheus.HistogramOpts
 
 type Counter prometheus.Counter
-type CounterVec *prometheus.CounterVec
+type CounterVec = *prometheus.CounterVec
 type Gauge prometheus.Gauge
+type GaugeVec = *prometheus.GaugeVec
 type Histogram prometheus.Histogram
+type HistogramVec = *prometheus.HistogramVec
 
 type responseWriter struct {
 	http.ResponseWriter
@@ -81,6 +83,14 @@ func NewGauge(opts GaugeOpts) Gauge {
 	return prometheus.NewGauge(prometheus.GaugeOpts(opts))
 }
 
+func NewVecGauge(opts GaugeOpts, labels []string) GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts(opts), labels)
+}
+
 func NewHistogram(opts HistogramOpts) prometheus.Histogram {
 	return prometheus.NewHistogram(prometheus.HistogramOpts(opts))
 }
+
+func NewVecHistogram(opts HistogramOpts, labels []string) HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts(opts), labels)
+}
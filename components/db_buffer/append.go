@@ -0,0 +1,54 @@
+package db_buffer
+
+import (
+	"errors"
+	"reflect"
+)
+
+// ErrHeightExists is returned when inserting a value which is not a slice for a height already buffered
+var ErrHeightExists = errors.New("height already buffered, use ReplaceHeight to overwrite it")
+
+// mergeHeightData returns the data to store for a height after inserting data: data itself if the height
+// is empty or replace is set, or the items of data appended to the existing ones otherwise
+func mergeHeightData(old interface{}, exists bool, data interface{}, replace bool) (interface{}, error) {
+	if !exists || replace {
+		return data, nil
+	}
+
+	if !isSlice(old) || !isSlice(data) || reflect.TypeOf(old) != reflect.TypeOf(data) {
+		return nil, ErrHeightExists
+	}
+
+	// a new slice is built, so the caller's backing arrays are never written
+	oldItems, newItems := reflect.ValueOf(old), reflect.ValueOf(data)
+	merged := reflect.MakeSlice(oldItems.Type(), 0, oldItems.Len()+newItems.Len())
+	merged = reflect.AppendSlice(merged, oldItems)
+	merged = reflect.AppendSlice(merged, newItems)
+
+	return merged.Interface(), nil
+}
+
+// accountInsert assigns the reserved space of the inserted data to key. When the height already existed, the
+// stored value replaces the old one, so a height counts as a single item however many times data is appended to it
+func (b *Buffer) accountInsert(key string, size uint64, old interface{}, exists bool, stored interface{}) {
+	b.budget.commit(key, size)
+	if exists {
+		b.accountMerge(key, old, size, stored)
+	}
+}
+
+// accountMerge releases the item and the bytes freed when the values of a height, of size old and added, were
+// merged into stored. For appends, this is what they shared, as the slice header
+func (b *Buffer) accountMerge(key string, old interface{}, added uint64, stored interface{}) {
+	freed := estimateSize(old) + added
+	if storedSize := estimateSize(stored); storedSize < freed {
+		freed -= storedSize
+	} else {
+		freed = 0
+	}
+	b.budget.release(key, 1, freed)
+}
+
+func isSlice(data interface{}) bool {
+	return data != nil && reflect.TypeOf(data).Kind() == reflect.Slice
+}
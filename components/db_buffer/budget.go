@@ -0,0 +1,321 @@
+package db_buffer
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// ErrBufferFull is returned by InsertData when the buffer budget is exceeded and BackpressureError is used
+var ErrBufferFull = errors.New("[Buffer] buffer is full")
+
+// BackpressurePolicy defines how InsertData behaves when the buffer budget is exceeded
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks InsertData until a sync frees enough space
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureError makes InsertData return ErrBufferFull, so the caller can slow down and retry
+	BackpressureError
+)
+
+// Sizer can be implemented by buffered data to supply its own size estimation, in bytes
+type Sizer interface {
+	BufferSize() uint64
+}
+
+type usage struct {
+	items int
+	bytes uint64
+}
+
+// budget keeps the amount of items and bytes buffered, and makes inserts wait for space when it is exceeded.
+// Its mutex is always the last lock taken: no other lock is taken while holding it, so the budget can be
+// updated under the buffer keysMutex
+type budget struct {
+	maxItems int
+	maxBytes uint64
+	policy   BackpressurePolicy
+	mutex    sync.Mutex
+	freed    *sync.Cond
+	total    usage
+	keys     map[string]*usage
+	closed   bool
+}
+
+func newBudget(cfg Config) *budget {
+	bg := &budget{
+		maxItems: int(cfg.MaxItems),
+		maxBytes: cfg.MaxBytes,
+		policy:   cfg.Backpressure,
+		keys:     make(map[string]*usage),
+	}
+	bg.freed = sync.NewCond(&bg.mutex)
+
+	return bg
+}
+
+func (bg *budget) isLimited() bool {
+	return bg.maxItems > 0 || bg.maxBytes > 0
+}
+
+// reserve takes space for an item of the given size, which must be then committed to its key or cancelled.
+// If the budget is exceeded, onFull is called and, depending on the policy, it waits for space or returns
+// ErrBufferFull. An item is always accepted when the buffer is empty, so items bigger than the budget do not
+// block forever. onFull is called without holding the budget mutex, as it takes the buffer locks
+func (bg *budget) reserve(size uint64, onFull func()) error {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	for bg.isFull(size) {
+		bg.mutex.Unlock()
+		onFull()
+		bg.mutex.Lock()
+
+		// space can be freed while unlocked, so it is checked again before waiting for it
+		if !bg.isFull(size) {
+			break
+		}
+		if bg.policy == BackpressureError {
+			return ErrBufferFull
+		}
+		bg.freed.Wait()
+	}
+
+	bg.total.items++
+	bg.total.bytes += size
+	return nil
+}
+
+// forceReserve takes space for an item of the given size, even if the budget is exceeded
+func (bg *budget) forceReserve(size uint64) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	bg.total.items++
+	bg.total.bytes += size
+}
+
+// commit assigns a reserved item of the given size to key, so it is released when key is cleared
+func (bg *budget) commit(key string, size uint64) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	u, ok := bg.keys[key]
+	if !ok {
+		u = &usage{}
+		bg.keys[key] = u
+	}
+
+	u.items++
+	u.bytes += size
+}
+
+// cancel returns the space of a reserved item which was not committed
+func (bg *budget) cancel(size uint64) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	bg.total.items--
+	bg.total.bytes -= size
+	bg.freed.Broadcast()
+}
+
+// isFull returns whether an item of the given size has to wait for space. bg.mutex must be held
+func (bg *budget) isFull(size uint64) bool {
+	return bg.isLimited() && !bg.closed && bg.total.items > 0 && !bg.fits(size)
+}
+
+func (bg *budget) fits(size uint64) bool {
+	if bg.maxItems > 0 && bg.total.items+1 > bg.maxItems {
+		return false
+	}
+
+	return bg.maxBytes == 0 || bg.total.bytes+size <= bg.maxBytes
+}
+
+// release returns the space of the given amount of items and bytes under key
+func (bg *budget) release(key string, items int, size uint64) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	if u, ok := bg.keys[key]; ok {
+		u.items -= items
+		u.bytes -= size
+		bg.total.items -= items
+		bg.total.bytes -= size
+	}
+	bg.freed.Broadcast()
+}
+
+// releaseKey returns the space of all the items under key
+func (bg *budget) releaseKey(key string) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	if u, ok := bg.keys[key]; ok {
+		bg.total.items -= u.items
+		bg.total.bytes -= u.bytes
+		delete(bg.keys, key)
+	}
+	bg.freed.Broadcast()
+}
+
+// detach removes the usage of key from it and returns it. The space stays taken until it is attached
+// back to a key or released with releaseUsage
+func (bg *budget) detach(key string) usage {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	var u usage
+	if ku, ok := bg.keys[key]; ok {
+		u = *ku
+		delete(bg.keys, key)
+	}
+
+	return u
+}
+
+// detachPart removes the usage u from key and returns it, capped to the usage of key
+func (bg *budget) detachPart(key string, u usage) usage {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	ku, ok := bg.keys[key]
+	if !ok {
+		return usage{}
+	}
+
+	if u.items > ku.items {
+		u.items = ku.items
+	}
+	if u.bytes > ku.bytes {
+		u.bytes = ku.bytes
+	}
+
+	ku.items -= u.items
+	ku.bytes -= u.bytes
+	return u
+}
+
+// attach adds a detached usage back to key
+func (bg *budget) attach(key string, u usage) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	ku, ok := bg.keys[key]
+	if !ok {
+		ku = &usage{}
+		bg.keys[key] = ku
+	}
+
+	ku.items += u.items
+	ku.bytes += u.bytes
+}
+
+// releaseUsage returns the space of a detached usage
+func (bg *budget) releaseUsage(u usage) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	bg.total.items -= u.items
+	bg.total.bytes -= u.bytes
+	bg.freed.Broadcast()
+}
+
+// close wakes up all the inserts waiting for space
+func (bg *budget) close() {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	bg.closed = true
+	bg.freed.Broadcast()
+}
+
+func (bg *budget) open() {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	bg.closed = false
+}
+
+// fullness returns the fraction of the budget in use, considering the most used of items and bytes
+func (bg *budget) fullness() float64 {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	var ratio float64
+	if bg.maxItems > 0 {
+		ratio = float64(bg.total.items) / float64(bg.maxItems)
+	}
+	if bg.maxBytes > 0 {
+		if r := float64(bg.total.bytes) / float64(bg.maxBytes); r > ratio {
+			ratio = r
+		}
+	}
+
+	return ratio
+}
+
+// estimateSize returns the size of data in bytes, as supplied by Sizer or estimated from its contents
+func estimateSize(data interface{}) uint64 {
+	if s, ok := data.(Sizer); ok {
+		return s.BufferSize()
+	}
+
+	if data == nil {
+		return 0
+	}
+
+	return estimateValueSize(reflect.ValueOf(data), 0)
+}
+
+// maxSizeDepth bounds the estimation of nested values, which also protects from pointer cycles
+const maxSizeDepth = 8
+
+func estimateValueSize(v reflect.Value, depth int) uint64 {
+	size := uint64(v.Type().Size())
+	if depth >= maxSizeDepth {
+		return size
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		size += uint64(v.Len())
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			size += estimateValueSize(v.Index(i), depth+1)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			size += estimateValueSize(iter.Key(), depth+1) + estimateValueSize(iter.Value(), depth+1)
+		}
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			size += estimateValueSize(v.Elem(), depth+1)
+		}
+	case reflect.Struct, reflect.Array:
+		// The inline fields are already included in the size, only what they reference is added
+		for i := 0; i < fieldsLen(v); i++ {
+			f := field(v, i)
+			size += estimateValueSize(f, depth+1) - uint64(f.Type().Size())
+		}
+	}
+
+	return size
+}
+
+func fieldsLen(v reflect.Value) int {
+	if v.Kind() == reflect.Struct {
+		return v.NumField()
+	}
+	return v.Len()
+}
+
+func field(v reflect.Value, i int) reflect.Value {
+	if v.Kind() == reflect.Struct {
+		return v.Field(i)
+	}
+	return v.Index(i)
+}
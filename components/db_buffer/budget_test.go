@@ -0,0 +1,130 @@
+package db_buffer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sizedData struct{}
+
+func (sizedData) BufferSize() uint64 {
+	return 42
+}
+
+func Test_EstimateSize(t *testing.T) {
+	assert.Equal(t, uint64(42), estimateSize(sizedData{}))
+	assert.Equal(t, uint64(16+5), estimateSize("hello"))
+	assert.Equal(t, uint64(24+2*8), estimateSize([]int64{1, 2}))
+
+	tx := ReportTransaction{TxFrom: "abc"}
+	assert.Equal(t, uint64(32+3), estimateSize(tx))
+}
+
+func Test_Backpressure(t *testing.T) {
+	for _, policy := range []BackpressurePolicy{BackpressureError, BackpressureBlock} {
+		buffer := NewDBBuffer(nil, Config{
+			SyncTimePeriod:     TestTimeout,
+			SyncBlockThreshold: 100,
+			MaxItems:           2,
+			Backpressure:       policy,
+		})
+		buffer.SetSyncFunc(func() SyncResult {
+			return SyncResult{}
+		})
+		buffer.Start()
+
+		for h := int64(0); h < 2; h++ {
+			assert.NoError(t, buffer.InsertData("transaction", h, createMockTx(int(h)), false))
+		}
+		assert.Equal(t, 1.0, buffer.budget.fullness())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- buffer.InsertData("transaction", 2, createMockTx(2), false)
+		}()
+
+		select {
+		case err := <-done:
+			if policy == BackpressureError {
+				assert.ErrorIs(t, err, ErrBufferFull)
+				// the full buffer triggered a sync, which frees space
+				<-buffer.SyncComplete
+				assert.NoError(t, buffer.InsertData("transaction", 2, createMockTx(2), false))
+			} else {
+				assert.NoError(t, err)
+			}
+		case <-time.After(TestSyncPeriod):
+			t.Fatal("timeout waiting for insert")
+		}
+
+		assert.Equal(t, 1, buffer.GetBufferSize("transaction"))
+		assert.Equal(t, 0.5, buffer.budget.fullness())
+		buffer.Stop()
+	}
+}
+
+func Test_BackpressureDuringSyncs(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 1,
+		MaxItems:           2,
+		Backpressure:       BackpressureBlock,
+	})
+	buffer.SetSyncFunc(func() SyncResult {
+		return SyncResult{}
+	})
+	buffer.SetKeySyncFunc("account", func() SyncResult {
+		return SyncResult{}
+	}, KeyConfig{})
+	buffer.Start()
+
+	// inserts on a full budget request syncs while other syncs swap their generations
+	done := make(chan error)
+	for _, key := range []string{"transaction", "account"} {
+		for w := 0; w < 4; w++ {
+			go func(key string, w int) {
+				for h := 0; h < 100; h++ {
+					if err := buffer.InsertData(key, int64(w*100+h), createMockTx(h), true); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}(key, w)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(TestSyncPeriod):
+			t.Fatal("inserts deadlocked with the syncs")
+		}
+	}
+
+	buffer.Stop()
+}
+
+func Test_ReserveOnFullTakesLocks(t *testing.T) {
+	bg := newBudget(Config{MaxItems: 1, Backpressure: BackpressureError})
+	assert.NoError(t, bg.reserve(1, func() {}))
+	bg.commit("transaction", 1)
+
+	// onFull triggers syncs, which update the budget while holding the buffer locks
+	done := make(chan error, 1)
+	go func() {
+		done <- bg.reserve(1, func() {
+			bg.attach("transaction", bg.detach("transaction"))
+		})
+	}()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrBufferFull)
+	case <-time.After(TestSyncPeriod):
+		t.Fatal("reserve deadlocked with onFull")
+	}
+}
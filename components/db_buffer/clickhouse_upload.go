@@ -0,0 +1,171 @@
+package db_buffer
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const clickhouseDialect = "clickhouse"
+
+// rejectedClickHouseCodes are the server error codes of inserts refused before any data is written, which are
+// expected to go away by sending the same block again
+var rejectedClickHouseCodes = map[int32]bool{
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	203: true, // NO_FREE_CONNECTION
+	241: true, // MEMORY_LIMIT_EXCEEDED
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+	285: true, // TOO_FEW_LIVE_REPLICAS
+}
+
+// ambiguousClickHouseCodes are the transient server error codes of inserts which may have been written anyway.
+// Once the block is sent, they are only retried if the server deduplicates it
+var ambiguousClickHouseCodes = map[int32]bool{
+	3:   true, // UNEXPECTED_END_OF_FILE
+	159: true, // TIMEOUT_EXCEEDED
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	236: true, // ABORTED
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	425: true, // SYSTEM_ERROR
+	999: true, // KEEPER_EXCEPTION
+}
+
+// insertQuery returns the ClickHouse batch insert of the columns of s
+func (s *copySource) insertQuery(db *gorm.DB) string {
+	stmt := &gorm.Statement{DB: db}
+
+	columns := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		columns[i] = stmt.Quote(c)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s)", stmt.Quote(s.table), strings.Join(columns, ", "))
+}
+
+// insertBlockWithRetry inserts the rows [from, to) as one block, sending it again while it fails with a
+// retryable error, up to cfg.MaxRetries times. loadId identifies the CopyToDB call in the deduplication token
+func (s *copySource) insertBlockWithRetry(ctx context.Context, sqlDB *sql.DB, query string, loadId string, from int, to int, cfg CopyConfig) (int64, error) {
+	settings := clickhouse.Settings{}
+	if cfg.AsyncInsert {
+		settings["async_insert"] = 1
+		settings["wait_for_async_insert"] = 1
+	}
+	if cfg.DeduplicatedInsert {
+		// every attempt sends the same token, so the server drops a resend of a block it already wrote
+		settings["insert_deduplication_token"] = fmt.Sprintf("%s:%s:%d-%d", s.table, loadId, from, to)
+		if cfg.AsyncInsert {
+			settings["async_insert_deduplicate"] = 1
+		}
+	}
+	if len(settings) > 0 {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+	}
+
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		inserted, sent, err := s.insertBlock(ctx, sqlDB, query, from, to)
+		if err == nil || attempt >= cfg.MaxRetries || !isRetryableClickHouseError(err, sent, cfg.DeduplicatedInsert) {
+			return inserted, err
+		}
+
+		zap.S().Warnf("[CopyToDB] rows %d to %d of %s failed, retrying in %s (%d/%d): %v",
+			from, to-1, s.table, backoff, attempt+1, cfg.MaxRetries, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return 0, err
+		}
+		backoff *= 2
+	}
+}
+
+// insertBlock inserts the rows [from, to) using a connection of sqlDB. The ClickHouse driver batches the rows of a
+// prepared insert in a transaction, and sends them as a single native columnar block on commit.
+// sent tells whether the error came from the commit, once the block may have reached the server
+func (s *copySource) insertBlock(ctx context.Context, sqlDB *sql.DB, query string, from int, to int) (int64, bool, error) {
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, false, err
+	}
+	defer stmt.Close()
+
+	for i := from; i < to; i++ {
+		values, err := s.values(ctx, i)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, values...)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, false, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, true, err
+	}
+
+	return int64(to - from), false, nil
+}
+
+// isRetryableClickHouseError tells whether err is a transient server or connection failure after which sending
+// the block again cannot duplicate it: the insert was refused, the block was not sent yet, or the server
+// deduplicates it
+func isRetryableClickHouseError(err error, sent bool, deduplicated bool) bool {
+	var exception *proto.Exception
+	if errors.As(err, &exception) {
+		return rejectedClickHouseCodes[exception.Code] ||
+			(ambiguousClickHouseCodes[exception.Code] && (!sent || deduplicated))
+	}
+
+	return isConnectionError(err) && (!sent || deduplicated)
+}
+
+// isConnectionError tells whether err is a failure of the connection to the server
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// newLoadId returns a random id, which keeps the deduplication tokens of different CopyToDB calls apart
+func newLoadId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
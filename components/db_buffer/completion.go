@@ -0,0 +1,132 @@
+package db_buffer
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/Zondax/zindexer/components/tracker"
+	"go.uber.org/zap"
+)
+
+// completeHeights keeps in r.SyncedHeights the heights whose data is not buffered anymore, apart from the data
+// synced by g, and adds the ones held back before which g completes. The rest are held back until the last
+// group holding their data syncs it, so a height is only tracked once all its keys are written.
+// The heights completed are forgotten by forgetPending once the sync succeeds
+func (b *Buffer) completeHeights(g *syncGroup, r *SyncResult) {
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	completed := make(map[uint64]bool)
+	if r.SyncedHeights != nil {
+		for _, h := range *r.SyncedHeights {
+			if b.isBuffered(g, h) {
+				b.pending[h] = r.Id
+				continue
+			}
+			completed[h] = true
+		}
+	}
+
+	for h, id := range b.pending {
+		if _, failed := r.FailedHeights[h]; id == r.Id && !failed && !b.isBuffered(g, h) {
+			completed[h] = true
+		}
+	}
+
+	synced := make([]uint64, 0, len(completed))
+	for h := range completed {
+		synced = append(synced, h)
+	}
+	sort.Slice(synced, func(i, j int) bool { return synced[i] < synced[j] })
+
+	r.completed = synced
+	if r.SyncedHeights != nil || len(synced) > 0 {
+		r.SyncedHeights = &synced
+	}
+}
+
+// isBuffered tells whether data of height is still buffered, in the active maps or in a sync other than the one
+// of g. keysMutex must be held
+func (b *Buffer) isBuffered(g *syncGroup, height uint64) bool {
+	heightKey := strconv.FormatUint(height, 10)
+
+	for _, m := range b.buffer {
+		if m.Has(heightKey) {
+			return true
+		}
+	}
+
+	for _, other := range append([]*syncGroup{b.defaultGroup}, b.groupList()...) {
+		if other == g || other.syncing == nil {
+			continue
+		}
+
+		for _, m := range other.syncing.maps {
+			if m.Has(heightKey) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// groupList returns the key groups. keysMutex must be held
+func (b *Buffer) groupList() []*syncGroup {
+	groups := make([]*syncGroup, 0, len(b.keyGroups))
+	for _, g := range b.keyGroups {
+		groups = append(groups, g)
+	}
+
+	return groups
+}
+
+// forgetPending removes the heights of a successful sync from the held back ones: the completed ones, which are
+// tracked, and the failed ones, which are re-enqueued
+func (b *Buffer) forgetPending(r *SyncResult) {
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
+
+	for _, h := range r.completed {
+		delete(b.pending, h)
+	}
+	for h := range r.FailedHeights {
+		delete(b.pending, h)
+	}
+}
+
+// dropPending releases the in-progress marks of the held back heights whose data was dropped with the sync of g,
+// so they are fetched again instead of being tracked without it
+func (b *Buffer) dropPending(g *syncGroup) {
+	if g.syncing == nil {
+		return
+	}
+
+	b.pendingMutex.Lock()
+	dropped := make(map[string][]uint64)
+	for h, id := range b.pending {
+		heightKey := strconv.FormatUint(h, 10)
+		for _, m := range g.syncing.maps {
+			if m.Has(heightKey) {
+				dropped[id] = append(dropped[id], h)
+				delete(b.pending, h)
+				break
+			}
+		}
+	}
+	b.pendingMutex.Unlock()
+
+	if b.dbConn == nil {
+		return
+	}
+
+	for id, heights := range dropped {
+		heights := heights
+		zap.S().Warnf("[Buffer] heights %v of %s were synced by other keys, but the data of %s was dropped", heights, id, g.name())
+		if err := tracker.UpdateInProgressHeight(false, &heights, id, b.dbConn); err != nil {
+			zap.S().Errorf("[Buffer] could not release dropped heights: %v", err)
+		}
+	}
+}
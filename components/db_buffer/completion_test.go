@@ -0,0 +1,39 @@
+package db_buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HeightsCompleteOnLastKey(t *testing.T) {
+	buffer := NewDBBuffer(unreachableDB(t), Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 1,
+	})
+
+	// blocks sync right away and report their heights, transactions are slower
+	buffer.SetKeySyncFunc("block", func() SyncResult {
+		return SyncResult{Id: "test", SyncedHeights: &[]uint64{1, 2}}
+	}, KeyConfig{})
+	buffer.SetSyncFunc(func() SyncResult {
+		return SyncResult{Id: "test", SyncedHeights: &[]uint64{}}
+	})
+	buffer.Start()
+	defer buffer.Stop()
+
+	assert.NoError(t, buffer.InsertData("transaction", 1, createMockTx(1), false))
+	assert.NoError(t, buffer.InsertData("block", 2, createMockTx(2), false))
+	assert.NoError(t, buffer.InsertData("block", 1, createMockTx(1), true))
+
+	// height 1 still has transactions buffered, so it is held back
+	result := <-buffer.SyncComplete
+	assert.NoError(t, result.Error)
+	assert.Equal(t, []uint64{2}, *result.SyncedHeights)
+
+	// and tracked by the sync of its last key
+	assert.NoError(t, buffer.callSync(buffer.defaultGroup))
+	result = <-buffer.SyncComplete
+	assert.Equal(t, []uint64{1}, *result.SyncedHeights)
+	assert.Empty(t, buffer.pending)
+}
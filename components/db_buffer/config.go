@@ -5,6 +5,58 @@ import "time"
 const DefaultSyncPeriod = 30 * time.Second
 
 type Config struct {
+	// Name labels the metrics of the buffer. Defaults to DefaultBufferName
+	Name               string
+	SyncTimePeriod     time.Duration
+	SyncBlockThreshold uint
+	// MaxItems is the maximum amount of heights buffered across all keys. 0 means no limit
+	MaxItems uint
+	// MaxBytes is the maximum estimated size of the buffered data. 0 means no limit.
+	// Data can implement Sizer to avoid the reflection based estimation
+	MaxBytes uint64
+	// Backpressure defines how InsertData behaves when MaxItems or MaxBytes are exceeded
+	Backpressure BackpressurePolicy
+	// WalDir enables the write-ahead log, stored in this directory, so buffered data survives a crash.
+	// Every key must have a registered type, see RegisterKeyType
+	WalDir string
+	// WalFsync flushes the write-ahead log to disk on every insert, to survive OS crashes too
+	WalFsync bool
+	// FailurePolicy defines what happens to the buffered data when a sync fails
+	FailurePolicy SyncFailurePolicy
+	// RetryBackoff is the time to wait before the first retry of a failed sync. It doubles on each failure
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the time between retries
+	MaxRetryBackoff time.Duration
+	// MaxSyncRetries is the amount of consecutive failed syncs SyncFailureRetry retries. Defaults to
+	// DefaultMaxSyncRetries, a negative value retries forever
+	MaxSyncRetries int
+	// RetriesExhaustedPolicy is applied once a sync failed more than MaxSyncRetries times in a row: SyncFailureDrop
+	// or SyncFailureHalt. Defaults to SyncFailureHalt
+	RetriesExhaustedPolicy SyncFailurePolicy
+	// IdempotentSync is for sync callbacks which cannot share a transaction with the tracker, but can write
+	// the same data twice (e.g. upserts). If the synced heights cannot be tracked, the sync is handled as failed
+	// and its data synced again
+	IdempotentSync bool
+	// MaxSyncsInFlight is the maximum amount of sync callbacks running at the same time, so it only applies across
+	// the callbacks set with SetKeySyncFunc: each callback runs one sync at a time, while the inserts of its keys
+	// go on. 0 means no limit
+	MaxSyncsInFlight uint
+	// Ordered syncs only the contiguous run of heights after the last synced one, see SetNextHeight. Heights
+	// above a gap are held until it is filled, and heights below the next one, reprocessed or below the first
+	// next height, are synced out of order with the next sync. It cannot be used with MaxItems nor MaxBytes.
+	// Every height must be inserted under a key of its sync callback, an empty slice is enough
+	Ordered bool
+	// GapTimeout is the time a gap can hold back buffered heights before it is alerted. See SetGapAlertFunc
+	GapTimeout time.Duration
+	// FlushOnStop makes Stop sync the data still buffered, so its heights are not fetched again after a restart
+	FlushOnStop bool
+	// FlushTimeout is the deadline of the final sync of Stop
+	FlushTimeout time.Duration
+}
+
+// KeyConfig defines when the data under a key with its own sync callback is synced.
+// Zero values default to the buffer Config
+type KeyConfig struct {
 	SyncTimePeriod     time.Duration
 	SyncBlockThreshold uint
 }
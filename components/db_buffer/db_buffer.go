@@ -2,236 +2,592 @@ package db_buffer
 
 import (
 	"fmt"
-	"github.com/Zondax/zindexer/components/connections/zmetrics"
 	"github.com/Zondax/zindexer/components/tracker"
 	cmap "github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"reflect"
 	"strconv"
 	"sync"
 	"time"
 )
 
-var (
-	defaultBucketTime = []float64{1, 5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60}
-)
-
 type SyncCB func() SyncResult
 
 type SyncResult struct {
 	Id            string
-	SyncedHeights *[]uint64 // Synced heights
-	Error         error     // Error in db insertion process
-}
+	SyncedHeights *[]uint64           // Synced heights
+	TypedHeights  map[string][]uint64 // Synced heights per data type, tracked on the id's data type sub-trackers
+	FailedHeights map[uint64]error    // Heights which could not be synced, with the reason. They are re-enqueued
+	Error         error               // Error in db insertion process
 
-type BufferMetrics struct {
-	totalSyncTimeHist zmetrics.Histogram
+	completed []uint64 // heights tracked by the sync, held back until then
 }
 
 type Buffer struct {
-	buffer       map[string]cmap.ConcurrentMap
-	dbConn       *gorm.DB
-	syncMutex    sync.Mutex
-	syncTicker   *time.Ticker
-	newDataChan  chan string
-	exitChan     chan bool
-	metrics      BufferMetrics
-	config       Config
-	syncCb       SyncCB
-	enabled      bool
-	SyncComplete chan SyncResult
+	name          string // labels the metrics
+	buffer        map[string]cmap.ConcurrentMap
+	keyTypes      map[string]reflect.Type
+	keyGroups     map[string]*syncGroup
+	keysMutex     sync.RWMutex // guards the buffer, keyTypes and keyGroups maps. Taken before the budget mutex
+	defaultGroup  *syncGroup
+	budget        *budget
+	wal           *wal
+	dbConn        *gorm.DB
+	config        Config
+	enabled       bool
+	haltMutex     sync.Mutex
+	haltErr       error
+	requeueFn     RequeueFn
+	syncSlots     chan struct{} // limits the syncs in progress to MaxSyncsInFlight, nil if unlimited
+	gapAlertFn    GapAlertFn
+	nextHeight    int64 // set by SetNextHeight, for the groups created later. Guarded by keysMutex
+	hasNextHeight bool
+	pending       map[uint64]string // heights synced by some keys, held back until all their keys are. Maps to the tracker id
+	pendingMutex  sync.Mutex        // taken before keysMutex
+	SyncComplete  chan SyncResult
+	Halted        chan error // receives the sync error which halted the buffer, with the SyncFailureHalt policy
 }
 
 func NewDBBuffer(db *gorm.DB, cfg Config) *Buffer {
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if cfg.MaxRetryBackoff < cfg.RetryBackoff {
+		cfg.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if cfg.MaxSyncRetries == 0 {
+		cfg.MaxSyncRetries = DefaultMaxSyncRetries
+	}
+	if cfg.RetriesExhaustedPolicy == SyncFailureRetry {
+		cfg.RetriesExhaustedPolicy = SyncFailureHalt
+	}
+	if cfg.GapTimeout <= 0 {
+		cfg.GapTimeout = DefaultGapTimeout
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = DefaultFlushTimeout
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = DefaultBufferName
+	}
+
 	b := &Buffer{
-		buffer:      make(map[string]cmap.ConcurrentMap),
-		dbConn:      db,
-		syncTicker:  time.NewTicker(cfg.SyncTimePeriod),
-		newDataChan: make(chan string),
-		exitChan:    make(chan bool, 1),
-		config:      cfg,
-		syncCb: func() SyncResult {
+		name:      cfg.Name,
+		buffer:    make(map[string]cmap.ConcurrentMap),
+		keyTypes:  make(map[string]reflect.Type),
+		keyGroups: make(map[string]*syncGroup),
+		pending:   make(map[uint64]string),
+		budget:    newBudget(cfg),
+		dbConn:    db,
+		config:    cfg,
+		defaultGroup: newSyncGroup("", func() SyncResult {
 			return SyncResult{
-				"",
-				nil,
-				fmt.Errorf("no sync function defined. Call SetSyncFunc"),
+				Error: fmt.Errorf("no sync function defined. Call SetSyncFunc"),
 			}
-		},
+		}, cfg.SyncTimePeriod, cfg.SyncBlockThreshold),
 		SyncComplete: make(chan SyncResult, 1),
+		Halted:       make(chan error, 1),
+	}
+
+	if cfg.MaxSyncsInFlight > 0 {
+		b.syncSlots = make(chan struct{}, cfg.MaxSyncsInFlight)
+	}
+
+	if cfg.WalDir != "" {
+		w, err := newWal(cfg.WalDir, cfg.WalFsync)
+		if err != nil {
+			zap.S().Error(err)
+			panic(err)
+		}
+		b.wal = w
 	}
 
-	b.registerMetrics()
-	b.syncTicker.Stop()
+	b.updateFullnessMetric()
 	return b
 }
 
-// Start starts listening for syncing triggering events
-func (b *Buffer) Start() {
-	go b.checkIsTimeToSync()
+// Start starts listening for syncing triggering events. In Ordered mode, it fails if SetNextHeight was not called,
+// or if the buffer has a budget: the heights held above a gap could fill it, and block the height filling the gap
+func (b *Buffer) Start() error {
+	if b.config.Ordered && b.budget.isLimited() {
+		return fmt.Errorf("[Buffer] Ordered mode cannot be used with MaxItems or MaxBytes")
+	}
+
+	if b.config.Ordered {
+		b.keysMutex.RLock()
+		hasNextHeight := b.hasNextHeight
+		b.keysMutex.RUnlock()
+		if !hasNextHeight {
+			return fmt.Errorf("[Buffer] Ordered mode requires SetNextHeight before Start")
+		}
+	}
+
+	b.budget.open()
+	for _, g := range b.getGroups() {
+		go b.checkIsTimeToSync(g)
+	}
 	b.enabled = true
+	return nil
 }
 
-// Stop stops listening for syncing triggering events
-func (b *Buffer) Stop() {
+// Stop stops listening for syncing triggering events. With FlushOnStop, it syncs the data still buffered
+// before returning, and returns an error if that final sync failed or did not finish within FlushTimeout.
+// The WAL and the sync tickers are released once the syncs still running at the deadline finish
+func (b *Buffer) Stop() error {
 	b.enabled = false
-	b.syncTicker.Stop()
-	// closes the loop in func checkIsTimeToSync
-	b.exitChan <- true
+	// wake up the inserts waiting for space
+	b.budget.close()
+	groups := b.getGroups()
+	for _, g := range groups {
+		g.stop()
+	}
+
+	release := func() {
+		for _, g := range groups {
+			g.syncTicker.Stop()
+		}
+
+		if b.wal != nil {
+			b.wal.close()
+		}
+	}
+
+	if !b.config.FlushOnStop {
+		release()
+		return nil
+	}
+
+	done, err := b.flush(groups, b.config.FlushTimeout)
+	select {
+	case <-done:
+		release()
+	default:
+		go func() {
+			<-done
+			release()
+		}()
+	}
 
-	// wait if a syncing event is in progress,
-	// syncMutex gets released in func callSync
-	b.syncMutex.Lock()
-	defer b.syncMutex.Unlock()
+	return err
 }
 
-// SetSyncFunc sets the syncing callback function
+// SetSyncFunc sets the syncing callback function of all the keys without their own callback
 func (b *Buffer) SetSyncFunc(cb SyncCB) {
-	b.syncCb = cb
+	b.defaultGroup.setSyncFunc(cb, nil)
+}
+
+// SetKeySyncFunc sets a syncing callback function for the data under key, with its own period and threshold.
+// The key is synced and cleared independently of the others, so a slow key does not hold back the rest.
+// A height is only complete once all its keys are synced: the heights reported in SyncResult.SyncedHeights are
+// tracked once no other key has data buffered for them, by the sync of the last key holding their data
+func (b *Buffer) SetKeySyncFunc(key string, cb SyncCB, cfg KeyConfig) {
+	b.setKeyGroup(key, cb, nil, cfg)
+}
+
+func (b *Buffer) setKeyGroup(key string, cb SyncCB, txCb TxSyncCB, cfg KeyConfig) {
+	if cfg.SyncTimePeriod <= 0 {
+		cfg.SyncTimePeriod = b.config.SyncTimePeriod
+	}
+	if cfg.SyncBlockThreshold == 0 {
+		cfg.SyncBlockThreshold = b.config.SyncBlockThreshold
+	}
+
+	if g := b.getGroup(key); g != b.defaultGroup {
+		g.syncMutex.Lock()
+		defer g.syncMutex.Unlock()
+
+		g.syncCb, g.txSyncCb = cb, txCb
+		g.period, g.threshold = cfg.SyncTimePeriod, cfg.SyncBlockThreshold
+		return
+	}
+
+	g := newSyncGroup(key, cb, cfg.SyncTimePeriod, cfg.SyncBlockThreshold)
+	g.txSyncCb = txCb
+	b.keysMutex.Lock()
+	b.keyGroups[key] = g
+	if b.hasNextHeight {
+		g.setNextHeight(b.nextHeight)
+	}
+	b.keysMutex.Unlock()
+
+	if b.enabled {
+		go b.checkIsTimeToSync(g)
+	}
 }
 
 // InsertData inserts 'data' into the buffer under the key 'key'
-// if notify is set to true, the condition 'SyncBlockThreshold' will be tested for that specific key
+// if notify is set to true, the condition 'SyncBlockThreshold' will be tested for that specific key.
+// If the height already holds a slice, the items of 'data' are appended to it. Other values cannot be
+// inserted twice for the same height, use ReplaceHeight to overwrite them.
+// If the buffer budget is exceeded, it blocks until a sync frees space or returns ErrBufferFull,
+// depending on the Backpressure policy
 func (b *Buffer) InsertData(key string, height int64, data interface{}, notify bool) error {
+	return b.insert(key, height, data, notify, false)
+}
+
+// AppendData appends the items of the slice 'data' to the ones buffered for height under key
+func (b *Buffer) AppendData(key string, height int64, data interface{}, notify bool) error {
+	if !isSlice(data) {
+		return fmt.Errorf("[Buffer] AppendData requires a slice, got %T", data)
+	}
+
+	return b.insert(key, height, data, notify, false)
+}
+
+// ReplaceHeight overwrites the data buffered for height under key, for deliberate re-processing
+func (b *Buffer) ReplaceHeight(key string, height int64, data interface{}, notify bool) error {
+	return b.insert(key, height, data, notify, true)
+}
+
+func (b *Buffer) insert(key string, height int64, data interface{}, notify bool, replace bool) error {
 	if !b.enabled {
 		return nil
 	}
 
-	b.syncMutex.Lock()
-	defer b.syncMutex.Unlock()
+	if err := b.haltError(); err != nil {
+		return fmt.Errorf("%w: %v", ErrHalted, err)
+	}
 
-	if _, ok := b.buffer[key]; !ok {
-		zap.S().Debugf("[Buffer] created new map for key %s", key)
-		b.buffer[key] = cmap.New()
+	g := b.getGroup(key)
+	size := estimateSize(data)
+	if err := b.budget.reserve(size, b.requestSync); err != nil {
+		return err
+	}
+	defer b.updateFullnessMetric()
+
+	// inserts only wait for the swap of generations, not for the sync
+	g.insertMutex.Lock()
+	defer g.insertMutex.Unlock()
+
+	m, err := b.getOrCreateMap(key, data)
+	if err != nil || !b.enabled {
+		b.budget.cancel(size)
+		return err
+	}
+
+	heightKey := strconv.FormatInt(height, 10)
+	old, exists := m.Get(heightKey)
+	value, err := mergeHeightData(old, exists, data, replace)
+	if err != nil {
+		b.budget.cancel(size)
+		return fmt.Errorf("[Buffer] key %s, height %d: %w", key, height, err)
+	}
+
+	if b.wal != nil {
+		if err = b.wal.append(key, height, data, replace); err != nil {
+			b.budget.cancel(size)
+			return err
+		}
 	}
 
-	b.buffer[key].Set(strconv.FormatInt(height, 10), data)
+	m.Set(heightKey, value)
+	b.accountInsert(key, size, old, exists, value)
+	if replace {
+		b.markReplaced(g, key, heightKey)
+	}
+	b.observeInsert(key)
+	b.updateItemsMetric(key)
 
 	if notify {
 		// this is done to write to the newDataChan in a non-blocking way
 		select {
-		case b.newDataChan <- key:
+		case g.newDataChan <- key:
 		default:
 		}
 	}
 
-	b.syncTicker.Reset(b.config.SyncTimePeriod)
+	// a failed sync is retried on its backoff, not postponed by new data
+	if g.retryDelay() == 0 {
+		g.syncTicker.Reset(g.period)
+	}
+	return nil
+}
+
+// RegisterKeyType restricts the data inserted under key to the type of sample. Keys must have a registered
+// type for the write-ahead log to decode their data on replay. TypedBuffer keys are registered already
+func (b *Buffer) RegisterKeyType(key string, sample interface{}) error {
+	return b.registerKeyType(key, reflect.TypeOf(sample))
+}
+
+// registerKeyType restricts the data inserted under key to type t
+func (b *Buffer) registerKeyType(key string, t reflect.Type) error {
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	if registered, ok := b.keyTypes[key]; ok && registered != t {
+		return fmt.Errorf("[Buffer] key %s already registered with type %s", key, registered)
+	}
+
+	b.keyTypes[key] = t
 	return nil
 }
 
+func (b *Buffer) getOrCreateMap(key string, data interface{}) (cmap.ConcurrentMap, error) {
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	t, ok := b.keyTypes[key]
+	if ok && reflect.TypeOf(data) != t {
+		return nil, fmt.Errorf("[Buffer] key %s holds %s, got %T", key, t, data)
+	}
+
+	if !ok && b.wal != nil {
+		return nil, fmt.Errorf("[Buffer] key %s has no registered type, required by the WAL", key)
+	}
+
+	if _, ok := b.buffer[key]; !ok {
+		zap.S().Debugf("[Buffer] created new map for key %s", key)
+		b.buffer[key] = cmap.New()
+	}
+
+	return b.buffer[key], nil
+}
+
+// getMap returns the data of key to read. While its sync callback runs, it is the generation being synced
+func (b *Buffer) getMap(key string) (cmap.ConcurrentMap, bool) {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	if g := b.groupOf(key); g.syncing != nil {
+		m, ok := g.syncing.maps[key]
+		return m, ok
+	}
+
+	m, ok := b.buffer[key]
+	return m, ok
+}
+
+// getActiveMap returns the map of key receiving the inserts
+func (b *Buffer) getActiveMap(key string) (cmap.ConcurrentMap, bool) {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	m, ok := b.buffer[key]
+	return m, ok
+}
+
+// getGroup returns the sync group in charge of key
+func (b *Buffer) getGroup(key string) *syncGroup {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	return b.groupOf(key)
+}
+
+// groupOf returns the sync group in charge of key. keysMutex must be held
+func (b *Buffer) groupOf(key string) *syncGroup {
+	if g, ok := b.keyGroups[key]; ok {
+		return g
+	}
+
+	return b.defaultGroup
+}
+
+func (b *Buffer) getGroups() []*syncGroup {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	groups := []*syncGroup{b.defaultGroup}
+	for _, g := range b.keyGroups {
+		groups = append(groups, g)
+	}
+
+	return groups
+}
+
+// ClearBuffer removes the data inserted under dataType. The data of a sync in progress is not affected
 func (b *Buffer) ClearBuffer(dataType string) {
-	if m, ok := b.buffer[dataType]; ok {
+	if m, ok := b.getActiveMap(dataType); ok {
 		m.Clear()
+		b.budget.releaseKey(dataType)
+		b.truncateWal(dataType)
+		b.updateItemsMetric(dataType)
+		b.updateFullnessMetric()
 	}
 }
 
-func (b *Buffer) clearAllBuffers() {
-	for _, m := range b.buffer {
-		m.Clear()
+func (b *Buffer) truncateWal(key string) {
+	if b.wal == nil {
+		return
+	}
+
+	if err := b.wal.truncate(key); err != nil {
+		zap.S().Errorf("[Buffer] could not truncate WAL of key %s: %v", key, err)
 	}
 }
 
+// requestSync asks all groups to sync, whatever their threshold
+func (b *Buffer) requestSync() {
+	for _, g := range b.getGroups() {
+		select {
+		case g.syncReqChan <- true:
+		default:
+		}
+	}
+}
+
+// GetBufferSize returns the amount of heights under dataType. Called from a sync callback, it is the amount being synced
 func (b *Buffer) GetBufferSize(dataType string) int {
 	size := 0
-	if m, ok := b.buffer[dataType]; ok {
+	if m, ok := b.getMap(dataType); ok {
 		size = m.Count()
 	}
 	return size
 }
 
+// activeSize returns the amount of heights inserted under key since its last sync started
+func (b *Buffer) activeSize(key string) uint {
+	if m, ok := b.getActiveMap(key); ok {
+		return uint(m.Count())
+	}
+	return 0
+}
+
+// GetData returns the data under dataType by height. Called from a sync callback, it is the data being synced
 func (b *Buffer) GetData(dataType string) (map[string]interface{}, error) {
-	if m, ok := b.buffer[dataType]; ok {
+	if m, ok := b.getMap(dataType); ok {
 		return m.Items(), nil
 	} else {
 		return nil, fmt.Errorf("[Buffer] buffer doesn't contain dataType %s", dataType)
 	}
 }
 
-func (b *Buffer) callSync() {
+// callSync syncs the data of g and returns the sync error
+func (b *Buffer) callSync(g *syncGroup) error {
 	zap.S().Debugf("[Buffer] callSync started ...")
 	defer func() {
 		zap.S().Debugf("[Buffer] callSync finished!")
 	}()
 
-	b.syncTicker.Stop()
-	b.syncMutex.Lock()
-	defer b.syncMutex.Unlock()
-	defer b.syncTicker.Reset(b.config.SyncTimePeriod)
+	g.syncTicker.Stop()
+	g.syncMutex.Lock()
+	defer g.syncMutex.Unlock()
+
+	// a halted buffer keeps its data, but does not sync anymore
+	if err := b.haltError(); err != nil {
+		return err
+	}
+	defer func() {
+		if b.haltError() == nil {
+			g.syncTicker.Reset(g.nextSyncDelay())
+		}
+	}()
+
+	b.acquireSyncSlot()
+	defer b.releaseSyncSlot()
+
+	// the data to sync is taken apart, so inserts go on while the callback runs
+	if b.config.Ordered {
+		b.reportStale(g, b.swapOrderedGeneration(g))
+		b.checkGap(g)
+	} else {
+		b.swapGeneration(g)
+	}
 
 	syncStart := time.Now()
-	syncResult := b.syncCb()
+	syncResult := b.runSync(g)
+	syncTime := time.Since(syncStart)
+	b.observeSync(g, syncResult.Error, syncTime)
+
+	policy := b.config.FailurePolicy
+	if syncResult.Error != nil {
+		policy = b.onSyncFailure(g, syncResult.Error)
+	} else {
+		zap.S().Debugf("[Buffer] Total DB insertion time took %v seconds", syncTime.Seconds())
+		b.observeRowsWritten(g.syncing)
+		b.onOrderedSync(g)
+		b.onSyncSuccess(g)
+	}
 
-	b.clearAllBuffers()
+	keep := syncResult.Error != nil && policy != SyncFailureDrop
+	if syncResult.Error == nil {
+		b.forgetPending(&syncResult)
+	} else if !keep {
+		b.dropPending(g)
+	}
 
-	if syncResult.Error == nil && syncResult.SyncedHeights != nil {
-		timeTotal := time.Since(syncStart).Seconds()
-		if timeTotal > 0 {
-			zap.S().Debugf("[Buffer] Total DB insertion time took %v seconds", timeTotal)
-			b.metrics.totalSyncTimeHist.Observe(timeTotal)
-		}
+	// the heights of dropped data are not in progress anymore
+	if syncResult.Error != nil && !keep {
+		b.releaseDropped(g, &syncResult)
+	}
+
+	if keep {
+		b.restoreGeneration(g)
+	} else {
+		b.dropGeneration(g)
 	}
 
-	b.onDBSyncComplete(&syncResult)
+	b.onFailedHeights(g, &syncResult)
 
 	select {
 	case b.SyncComplete <- syncResult:
 	default:
 	}
+
+	return syncResult.Error
 }
 
-func (b *Buffer) checkIsTimeToSync() {
+func (b *Buffer) checkIsTimeToSync(g *syncGroup) {
 	for {
 		select {
-		case <-b.syncTicker.C:
-			zap.S().Debug("[Buffer] Syncing because of Ticker...")
-			b.callSync()
-		case key := <-b.newDataChan:
-			l := uint(b.GetBufferSize(key))
-			if l >= b.config.SyncBlockThreshold {
-				zap.S().Debugf("[Buffer] Syncing because of blocks amount: %d", l)
-				b.callSync()
+		case <-g.syncTicker.C:
+			zap.S().Debugf("[Buffer] Syncing %s because of Ticker...", g.name())
+			b.observeTrigger(g, triggerTicker)
+			b.callSync(g)
+		case key := <-g.newDataChan:
+			l := b.activeSize(key)
+			if b.config.Ordered {
+				l = b.orderedRunSize(g)
+			}
+			if l >= g.threshold && g.retryDelay() == 0 {
+				zap.S().Debugf("[Buffer] Syncing %s because of blocks amount: %d", g.name(), l)
+				b.observeTrigger(g, triggerThreshold)
+				b.callSync(g)
 			}
-		case <-b.exitChan:
-			zap.S().Debug("[Buffer] Exiting...")
+		case <-g.syncReqChan:
+			if g.retryDelay() > 0 {
+				continue
+			}
+			zap.S().Debugf("[Buffer] Syncing %s because the buffer is full...", g.name())
+			b.observeTrigger(g, triggerFull)
+			b.callSync(g)
+		case <-g.exitChan:
+			zap.S().Debugf("[Buffer] Exiting %s...", g.name())
 			return
 		}
 	}
 }
 
-func (b *Buffer) registerMetrics() {
-	b.metrics.totalSyncTimeHist = zmetrics.NewHistogram(zmetrics.HistogramOpts{
-		Namespace: "blocks",
-		Subsystem: "buffer",
-		Name:      "sync_total_time_seconds",
-		Help:      "Total time spent by function 'syncCb'",
-		Buckets:   defaultBucketTime,
-	})
-
-	err := zmetrics.RegisterMetric(b.metrics.totalSyncTimeHist)
-	if err != nil {
-		zap.S().Error("Could not register Metric: totalSyncTimeHist")
-	}
-}
-
-func (b *Buffer) onDBSyncComplete(r *SyncResult) {
-	if r.SyncedHeights == nil {
+// onDBSyncComplete updates the tracker with the result of a sync of g, using db, which can be the sync transaction
+func (b *Buffer) onDBSyncComplete(g *syncGroup, r *SyncResult, db *gorm.DB) error {
+	if r.SyncedHeights == nil && len(r.TypedHeights) == 0 && len(r.FailedHeights) == 0 {
 		zap.S().Errorf("onDBSyncComplete received nil SyncedHeights. Check db_sync code!")
-		return
+		return nil
 	}
 
 	if r.Id == "" {
 		zap.S().Errorf("onDBSyncComplete received an empty 'Id'. Check db_sync code!")
-		return
+		return nil
 	}
 
-	if r.Error != nil {
-		zap.S().Errorf(r.Error.Error())
-		// Remove WIP heights
-		_ = tracker.UpdateInProgressHeight(false, r.SyncedHeights, r.Id, b.dbConn)
-		return
+	r.removeFailedHeights()
+
+	for dataType, heights := range r.TypedHeights {
+		heights := heights
+		err := tracker.UpdateTrackedHeightsForType(&heights, r.Id, dataType, db)
+		if err != nil {
+			zap.S().Errorf("onDBSyncComplete could not track data type '%s': %v", dataType, err)
+			return err
+		}
 	}
 
-	err := tracker.UpdateAndRemoveWipHeights(r.SyncedHeights, r.Id, b.dbConn)
-	if err != nil {
-		return
+	// Heights still buffered under other keys are held back until they are synced
+	b.completeHeights(g, r)
+	if r.SyncedHeights == nil || len(*r.SyncedHeights) == 0 {
+		return nil
 	}
+
+	return tracker.UpdateAndRemoveWipHeights(r.SyncedHeights, r.Id, db)
 }
@@ -187,3 +187,130 @@ func Test_BufferStop(t *testing.T) {
 		}
 	}
 }
+
+func Test_TypedBuffer(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestSyncPeriod,
+		SyncBlockThreshold: TestBlocksThreshold,
+	})
+	buffer.Start()
+	defer buffer.Stop()
+
+	txsBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "transaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []int{3, 1, 2} {
+		err = txsBuffer.InsertData(int64(h), []ReportTransaction{createMockTx(h), createMockTx(h)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, heights, err := txsBuffer.GetItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []uint64{1, 2, 3}, heights)
+	assert.Len(t, items, 6)
+	for i, item := range items {
+		assert.Equal(t, int64(i/2+1), item.Height)
+	}
+
+	_, err = RegisterTypedBuffer[int](buffer, "transaction")
+	assert.Error(t, err)
+
+	err = buffer.InsertData("transaction", 4, "not a transaction", false)
+	assert.Error(t, err)
+}
+
+func Test_KeySyncFunc(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 100,
+	})
+	buffer.SetSyncFunc(func() SyncResult {
+		t.Error("default sync function should not be called")
+		return SyncResult{}
+	})
+
+	blocksSynced := make(chan []uint64, 1)
+	blocksBuffer, err := RegisterTypedBuffer[int64](buffer, "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.SetKeySyncFunc("block", func() SyncResult {
+		_, heights, err := blocksBuffer.GetItems()
+		if err != nil {
+			t.Error(err)
+		}
+		blocksSynced <- heights
+		return SyncResult{TypedHeights: map[string][]uint64{"block": heights}}
+	}, KeyConfig{SyncBlockThreshold: 2})
+
+	buffer.Start()
+	defer buffer.Stop()
+
+	for h := int64(0); h < 2; h++ {
+		if err = blocksBuffer.InsertData(h, []int64{h}, true); err != nil {
+			t.Fatal(err)
+		}
+		if err = buffer.InsertData("transaction", h, []ReportTransaction{createMockTx(int(h))}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case heights := <-blocksSynced:
+		assert.Equal(t, []uint64{0, 1}, heights)
+	case <-time.After(TestSyncPeriod):
+		t.Fatal("timeout waiting for key sync")
+	}
+
+	<-buffer.SyncComplete
+	assert.Equal(t, 0, buffer.GetBufferSize("block"))
+	assert.Equal(t, 2, buffer.GetBufferSize("transaction"))
+}
+
+func Test_MultipleValuesPerHeight(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 100,
+		MaxItems:           10,
+	})
+	buffer.Start()
+	defer buffer.Stop()
+
+	txsBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "transaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := []ReportTransaction{createMockTx(1)}
+	assert.NoError(t, txsBuffer.InsertData(1, first, false))
+	assert.NoError(t, buffer.AppendData("transaction", 1, []ReportTransaction{createMockTx(1), createMockTx(1)}, false))
+	assert.Len(t, first, 1, "appending must not modify the inserted slice")
+
+	data, err := txsBuffer.GetData()
+	assert.NoError(t, err)
+	assert.Len(t, data[1], 3)
+	assert.Equal(t, 1, buffer.budget.total.items, "a height is a single budget item")
+
+	assert.NoError(t, txsBuffer.ReplaceHeight(1, []ReportTransaction{createMockTx(1)}, false))
+	data, err = txsBuffer.GetData()
+	assert.NoError(t, err)
+	assert.Len(t, data[1], 1)
+	assert.Equal(t, estimateSize(data[1]), buffer.budget.total.bytes)
+
+	assert.Error(t, buffer.AppendData("block", 1, int64(1), false))
+	assert.NoError(t, buffer.InsertData("block", 1, int64(1), false))
+	assert.ErrorIs(t, buffer.InsertData("block", 1, int64(2), false), ErrHeightExists)
+	assert.NoError(t, buffer.ReplaceHeight("block", 1, int64(2), false))
+
+	blocks, err := buffer.GetData("block")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), blocks["1"])
+}
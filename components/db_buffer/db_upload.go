@@ -2,117 +2,425 @@ package db_buffer
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zondax/zindexer/components/connections/database"
 	"github.com/Zondax/zindexer/components/connections/database/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/jszwec/csvutil"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	"os"
-	"os/exec"
-	"runtime"
-	"strconv"
-	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	DefaultCopyChunkSize    = 10000
+	DefaultCopyRetries      = 3
+	DefaultCopyRetryBackoff = time.Second
+)
+
+// CopyConfig defines how CopyToDB splits the rows
+type CopyConfig struct {
+	// Workers is the amount of COPY streams, or ClickHouse inserts, run in parallel. Defaults to the amount of CPUs
+	Workers int
+	// ChunkSize is the amount of rows sent by each COPY stream, or in each ClickHouse block.
+	// Defaults to DefaultCopyChunkSize
+	ChunkSize int
+	// AsyncInsert lets the ClickHouse server buffer the blocks and merge them with other inserts before
+	// writing them (async_insert). Each block is still acknowledged once written
+	AsyncInsert bool
+	// DeduplicatedInsert tells that the ClickHouse table deduplicates inserted blocks: a Replicated*MergeTree, or a
+	// MergeTree with non_replicated_deduplication_window set. Each block is then sent with an
+	// insert_deduplication_token, and retried also after errors where it may have been written, such as
+	// UNKNOWN_STATUS_OF_INSERT or a connection lost on commit. Without it, those errors are not retried
+	DeduplicatedInsert bool
+	// MaxRetries is the amount of times a ClickHouse block failing with a retryable error is sent again.
+	// Defaults to DefaultCopyRetries, a negative value disables retries
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled on each one. Defaults to DefaultCopyRetryBackoff
+	RetryBackoff time.Duration
+}
+
+// CopyToDB bulk loads rows, a slice of structs or struct pointers, into table. Columns are mapped from the
+// gorm tags of the struct, as gorm does for inserts, and values are sent typed. table can be schema qualified,
+// and defaults to the table of the model.
+// On Postgres it uses the COPY protocol, in binary format. On ClickHouse it uses native batch inserts, sending
+// each chunk as one columnar block. A failed block is sent again only if it cannot be duplicated, see
+// CopyConfig.DeduplicatedInsert.
+// Rows are split in chunks loaded in parallel, each one committed on its own: on error, the chunks loaded
+// before are kept. The chunks use connections of the pool of db, so it cannot run within a transaction, as the
+// one of a TxSyncCB. It returns the amount of rows loaded
+func CopyToDB(db *gorm.DB, table string, rows interface{}, cfg CopyConfig) (int64, error) {
+	src, err := newCopySource(db, table, rows)
+	if err != nil || src.len() == 0 {
+		return 0, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return 0, fmt.Errorf("[CopyToDB] %w", err)
+	}
+
+	cfg.setDefaults()
+
+	load := src.copyChunk
+	if db.Dialector.Name() == clickhouseDialect {
+		query := src.insertQuery(db)
+		loadId, err := newLoadId()
+		if err != nil {
+			return 0, fmt.Errorf("[CopyToDB] %w", err)
+		}
+		load = func(ctx context.Context, sqlDB *sql.DB, from int, to int) (int64, error) {
+			return src.insertBlockWithRetry(ctx, sqlDB, query, loadId, from, to, cfg)
+		}
+	}
+
+	ctx := context.Background()
+	if db.Statement != nil && db.Statement.Context != nil {
+		ctx = db.Statement.Context
+	}
+
+	return loadChunks(ctx, sqlDB, src.table, src.len(), cfg, load)
+}
+
+func (cfg *CopyConfig) setDefaults() {
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = DefaultCopyChunkSize
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultCopyRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultCopyRetryBackoff
+	}
+}
+
+// chunkLoader loads the rows [from, to) using a connection of sqlDB, and returns the amount of rows loaded
+type chunkLoader func(ctx context.Context, sqlDB *sql.DB, from int, to int) (int64, error)
+
+// loadChunks splits 'rows' rows in chunks of cfg.ChunkSize, loaded in parallel by cfg.Workers. It stops at
+// the first error, keeping the chunks loaded before
+func loadChunks(ctx context.Context, sqlDB *sql.DB, table string, rows int, cfg CopyConfig, load chunkLoader) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan [2]int)
+	go func() {
+		defer close(chunks)
+		for from := 0; from < rows; from += cfg.ChunkSize {
+			to := from + cfg.ChunkSize
+			if to > rows {
+				to = rows
+			}
+
+			select {
+			case chunks <- [2]int{from, to}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		copied   int64
+		firstErr error
+	)
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				n, err := load(ctx, sqlDB, c[0], c[1])
+
+				mutex.Lock()
+				copied += n
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("[CopyToDB] rows %d to %d of %s: %w", c[0], c[1]-1, table, err)
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		zap.S().Errorf("%v. %d of %d rows loaded", firstErr, copied, rows)
+		return copied, firstErr
+	}
+
+	return copied, nil
+}
+
+var (
+	legacyDBMutex  sync.Mutex
+	legacyDB       *gorm.DB
+	legacyDBParams database.DBConnectionParams
 )
 
+// ParallelCopyTxsToDB copies transactions into tableName, in the schema 'db_schema', connecting to the
+// database set in the 'db' settings. The connection is kept for the next calls.
+// As the CSV upload it replaces, the exported fields of the rows are encoded from their csv tags, which name
+// the columns of the table they are copied to.
+// Deprecated: use CopyToDB with an open connection, which maps the columns from the gorm tags
 func ParallelCopyTxsToDB(transactions interface{}, tableName string) error {
 	if transactions == nil {
 		return nil
 	}
 
-	filePath, err := writeCsvRecords(tableName, transactions)
+	rows := reflect.ValueOf(transactions)
+	if rows.Kind() != reflect.Slice {
+		return fmt.Errorf("[ParallelCopyTxsToDB] transactions must be a slice, got %T", transactions)
+	}
+	if rows.Len() == 0 {
+		return nil
+	}
+
+	db, err := legacyConnection()
 	if err != nil {
 		return err
 	}
 
-	defer func(filePath string) {
-		err := deleteFile(filePath)
-		if err != nil {
-			zap.S().Error(err)
-		}
-	}(filePath)
-
-	err = uploadCSV(filePath, tableName)
+	sqlDB, err := db.DB()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	table := postgres.GetTableNameWithoutSchema(tableName)
+	if schemaName := viper.GetString("db_schema"); schemaName != "" {
+		table = schemaName + "." + table
+	}
+	query, err := csvCopyQuery(table, rows.Type().Elem())
+	if err != nil {
+		return fmt.Errorf("[ParallelCopyTxsToDB] %w", err)
+	}
+
+	cfg := CopyConfig{}
+	cfg.setDefaults()
+	_, err = loadChunks(context.Background(), sqlDB, table, rows.Len(), cfg, func(ctx context.Context, sqlDB *sql.DB, from int, to int) (int64, error) {
+		return copyCsvChunk(ctx, sqlDB, query, rows.Slice(from, to).Interface())
+	})
+	return err
 }
 
-func writeCsvRecords(itemName string, records interface{}) (string, error) {
-	marshaled, err := csvutil.Marshal(records)
+// csvCopyQuery returns the COPY query of rows of type rowType into table, with the columns named by their csv tags
+func csvCopyQuery(table string, rowType reflect.Type) (string, error) {
+	for rowType.Kind() == reflect.Pointer {
+		rowType = rowType.Elem()
+	}
+
+	header, err := csvutil.Header(reflect.New(rowType).Interface(), "csv")
 	if err != nil {
-		zap.S().Error(err.Error())
 		return "", err
 	}
 
-	currTime := time.Now().Unix()
-	filePath := fmt.Sprintf("%s/%s_%d.csv", ".", itemName, currTime)
-	f, err := os.Create(filePath)
+	columns := make([]string, 0, len(header))
+	for _, c := range header {
+		columns = append(columns, pgx.Identifier{c}.Sanitize())
+	}
 
+	return fmt.Sprintf("COPY %s (%s) FROM STDIN WITH (FORMAT csv, HEADER true)",
+		pgx.Identifier(strings.Split(table, ".")).Sanitize(), strings.Join(columns, ", ")), nil
+}
+
+// legacyConnection returns the connection used by ParallelCopyTxsToDB, opened again if the 'db' settings changed
+func legacyConnection() (*gorm.DB, error) {
+	legacyDBMutex.Lock()
+	defer legacyDBMutex.Unlock()
+
+	params := database.DBConnectionParams{
+		Name:     viper.GetString("db.name"),
+		Host:     viper.GetString("db.host"),
+		Port:     viper.GetString("db.port"),
+		User:     viper.GetString("db.user"),
+		Password: viper.GetString("db.password"),
+	}
+	if legacyDB != nil && params == legacyDBParams {
+		return legacyDB, nil
+	}
+
+	db, err := postgres.Connect(params, postgres.DBConnectionConfig{})
 	if err != nil {
-		zap.S().Errorf("failed to open file, err: %v", err)
-		return "", err
+		return nil, err
 	}
-	defer f.Close()
 
-	file, err := os.OpenFile(
-		filePath,
-		os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
-		0666,
-	)
+	if legacyDB != nil {
+		if sqlDB, err := legacyDB.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	}
+
+	legacyDB, legacyDBParams = db, params
+	return db, nil
+}
+
+// copyCsvChunk encodes rows as CSV from their csv tags, and copies them with query using a connection of sqlDB
+func copyCsvChunk(ctx context.Context, sqlDB *sql.DB, query string, rows interface{}) (int64, error) {
+	data, err := csvutil.Marshal(rows)
 	if err != nil {
-		zap.S().Error(err)
-		return "", err
+		return 0, err
 	}
-	defer file.Close()
 
-	_, err2 := file.Write(marshaled)
-	if err2 != nil {
-		zap.S().Error(err2)
-		return "", err2
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return 0, err
 	}
-	return filePath, nil
+	defer conn.Close()
+
+	var copied int64
+	err = conn.Raw(func(driverConn interface{}) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("COPY requires the pgx postgres driver, got %T", driverConn)
+		}
+
+		tag, err := pgxConn.Conn().PgConn().CopyFrom(ctx, bytes.NewReader(data), query)
+		copied = tag.RowsAffected()
+		return err
+	})
+
+	return copied, err
 }
 
-func uploadCSV(filePath string, destinationTable string) error {
-	cmdPath := viper.GetString("db_batch_insert_cmd")
+// copySource maps the rows to copy to the columns of their table
+type copySource struct {
+	table   string
+	ident   pgx.Identifier
+	columns []string
+	fields  []*schema.Field
+	rows    reflect.Value
+}
 
-	var (
-		dbName     = viper.GetString("db.name")
-		dbHost     = viper.GetString("db.host")
-		dbPort     = viper.GetString("db.port")
-		dbUser     = viper.GetString("db.user")
-		dbPassword = viper.GetString("db.password")
-		dbSchema   = viper.GetString("db_schema")
-	)
+func newCopySource(db *gorm.DB, table string, rows interface{}) (*copySource, error) {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("[CopyToDB] rows must be a slice, got %T", rows)
+	}
 
-	workersCount := strconv.FormatInt(int64(runtime.NumCPU()), 10)
-	tableName := postgres.GetTableNameWithoutSchema(destinationTable)
-	dbConnParams := fmt.Sprintf("'host=%s user=%s password=%s port=%s sslmode=disable'", dbHost, dbUser, dbPassword, dbPort)
-	insertParams := fmt.Sprintf("%s --db-name %s --schema %s --table %s --connection %s --file %s --workers %s --skip-header", cmdPath, dbName, dbSchema, tableName, dbConnParams, filePath, workersCount)
-	cmd := exec.Command("/bin/sh", "-c", insertParams)
+	model := reflect.New(v.Type().Elem()).Interface()
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, fmt.Errorf("[CopyToDB] could not map %s to a table: %w", v.Type().Elem(), err)
+	}
 
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+	if table == "" {
+		table = stmt.Table
+	}
 
-	err := cmd.Run()
-	if err != nil {
-		zap.S().Errorf("Error executing CLI command to upload CSV file %s: %+v (%+v) (%+v)", filePath, stderr.String(), out.String(), err.Error())
-		return err
+	src := &copySource{
+		table: table,
+		ident: pgx.Identifier(strings.Split(table, ".")),
+		rows:  v,
 	}
 
-	return nil
+	for _, f := range stmt.Schema.Fields {
+		if f.DBName == "" || !f.Creatable {
+			continue
+		}
+
+		if f.AutoIncrement {
+			generated, err := src.generated(db, f)
+			if err != nil {
+				return nil, err
+			}
+			if generated {
+				continue
+			}
+		}
+
+		src.columns = append(src.columns, f.DBName)
+		src.fields = append(src.fields, f)
+	}
+
+	return src, nil
+}
+
+// generated tells whether the auto increment field f is left to the database, as gorm does when it is zero.
+// gorm also marks untagged integer primary keys as auto increment, so f is copied when the rows set it.
+// COPY has no per row DEFAULT, so f must be set in all the rows or in none
+func (s *copySource) generated(db *gorm.DB, f *schema.Field) (bool, error) {
+	ctx := context.Background()
+	if db.Statement != nil && db.Statement.Context != nil {
+		ctx = db.Statement.Context
+	}
+
+	var set, unset int
+	for i := 0; i < s.len(); i++ {
+		row := reflect.Indirect(s.rows.Index(i))
+		if !row.IsValid() {
+			continue
+		}
+
+		if _, isZero := f.ValueOf(ctx, row); isZero {
+			unset++
+		} else {
+			set++
+		}
+	}
+
+	if set > 0 && unset > 0 {
+		return false, fmt.Errorf("[CopyToDB] column %s of %s is set in %d rows and zero in %d: it must be set in all the rows or in none",
+			f.DBName, s.table, set, unset)
+	}
+
+	return set == 0, nil
 }
 
-func deleteFile(filePath string) error {
-	err := os.Remove(filePath)
+func (s *copySource) len() int {
+	return s.rows.Len()
+}
+
+// values returns the column values of row i
+func (s *copySource) values(ctx context.Context, i int) ([]interface{}, error) {
+	row := reflect.Indirect(s.rows.Index(i))
+	if !row.IsValid() {
+		return nil, fmt.Errorf("row %d is nil", i)
+	}
+
+	values := make([]interface{}, len(s.fields))
+	for j, f := range s.fields {
+		values[j], _ = f.ValueOf(ctx, row)
+	}
+
+	return values, nil
+}
+
+// copyChunk copies the rows [from, to) using a connection of sqlDB
+func (s *copySource) copyChunk(ctx context.Context, sqlDB *sql.DB, from int, to int) (int64, error) {
+	conn, err := sqlDB.Conn(ctx)
 	if err != nil {
-		zap.S().Errorf("Error removing file %s after DB upload: %s", filePath, err.Error())
-		return err
+		return 0, err
 	}
+	defer conn.Close()
+
+	var copied int64
+	err = conn.Raw(func(driverConn interface{}) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("COPY requires the pgx postgres driver, got %T", driverConn)
+		}
+
+		source := pgx.CopyFromSlice(to-from, func(i int) ([]interface{}, error) {
+			return s.values(ctx, from+i)
+		})
+
+		copied, err = pgxConn.Conn().CopyFrom(ctx, s.ident, s.columns, source)
+		return err
+	})
 
-	return nil
+	return copied, err
 }
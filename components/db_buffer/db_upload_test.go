@@ -0,0 +1,117 @@
+package db_buffer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/proto"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/clickhouse"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type heightRow struct {
+	Height int64 `gorm:"primaryKey"`
+	Hash   string
+}
+
+type copyRow struct {
+	Id     uint64 `gorm:"primaryKey;autoIncrement"`
+	Height int64
+	TxFrom string `gorm:"column:sender"`
+	Memo   string `gorm:"-"`
+}
+
+func Test_CopySource(t *testing.T) {
+	db := unreachableDB(t)
+	rows := []*copyRow{{Height: 1, TxFrom: "a", Memo: "ignored"}, {Height: 2, TxFrom: "b"}}
+
+	src, err := newCopySource(db, "", rows)
+	assert.NoError(t, err)
+	assert.Equal(t, pgx.Identifier{"copy_rows"}, src.ident)
+	assert.Equal(t, []string{"height", "sender"}, src.columns)
+
+	values, err := src.values(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(2), "b"}, values)
+
+	src, err = newCopySource(db, "indexer.txs", rows)
+	assert.NoError(t, err)
+	assert.Equal(t, pgx.Identifier{"indexer", "txs"}, src.ident)
+
+	_, err = newCopySource(db, "", copyRow{})
+	assert.Error(t, err)
+
+	// untagged integer primary keys are auto increment for gorm, but copied when set
+	src, err = newCopySource(db, "", []heightRow{{Height: 10, Hash: "a"}, {Height: 11, Hash: "b"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"height", "hash"}, src.columns)
+
+	src, err = newCopySource(db, "", []copyRow{{Id: 7, Height: 1}, {Id: 8, Height: 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "height", "sender"}, src.columns)
+
+	_, err = newCopySource(db, "", []heightRow{{Height: 10}, {Hash: "b"}})
+	assert.ErrorContains(t, err, "column height")
+
+	// connection errors are reported with the rows which could not be copied
+	copied, err := CopyToDB(db, "", rows, CopyConfig{Workers: 2, ChunkSize: 1})
+	assert.Equal(t, int64(0), copied)
+	assert.ErrorContains(t, err, "copy_rows")
+}
+
+func Test_ClickHouseInsert(t *testing.T) {
+	db, err := gorm.Open(clickhouse.New(clickhouse.Config{DSN: "clickhouse://127.0.0.1:1/default?dial_timeout=1s", SkipInitializeWithVersion: true}),
+		&gorm.Config{DisableAutomaticPing: true, Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []copyRow{{Height: 1, TxFrom: "a"}, {Height: 2, TxFrom: "b"}}
+
+	src, err := newCopySource(db, "indexer.txs", rows)
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT INTO `indexer`.`txs` (`height`, `sender`)", src.insertQuery(db))
+
+	assert.True(t, isRetryableClickHouseError(fmt.Errorf("insert: %w", &proto.Exception{Code: 252}), true, false))
+	assert.False(t, isRetryableClickHouseError(&proto.Exception{Code: 60}, false, true)) // UNKNOWN_TABLE
+	assert.True(t, isRetryableClickHouseError(syscall.ECONNREFUSED, false, false))
+	assert.False(t, isRetryableClickHouseError(fmt.Errorf("invalid value"), false, true))
+
+	// a block which may have been written is only sent again if the server deduplicates it
+	unknownStatus := &proto.Exception{Code: 319} // UNKNOWN_STATUS_OF_INSERT
+	assert.False(t, isRetryableClickHouseError(unknownStatus, true, false))
+	assert.True(t, isRetryableClickHouseError(unknownStatus, true, true))
+	assert.False(t, isRetryableClickHouseError(io.EOF, true, false))
+	assert.True(t, isRetryableClickHouseError(io.EOF, false, false))
+
+	// connection errors are retried, then reported with the rows which could not be inserted
+	start := time.Now()
+	copied, err := CopyToDB(db, "", rows, CopyConfig{Workers: 1, MaxRetries: 2, RetryBackoff: 10 * time.Millisecond})
+	assert.Equal(t, int64(0), copied)
+	assert.ErrorContains(t, err, "copy_rows")
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+}
+
+func Test_ParallelCopyTxsToDB(t *testing.T) {
+	// nothing to copy does not connect
+	assert.NoError(t, ParallelCopyTxsToDB(nil, "transactions"))
+	assert.NoError(t, ParallelCopyTxsToDB([]ReportTransaction{}, "transactions"))
+	assert.ErrorContains(t, ParallelCopyTxsToDB(ReportTransaction{}, "transactions"), "must be a slice")
+
+	// the columns are named by the csv tags, not taken by position
+	type csvTx struct {
+		TxFrom string `csv:"tx_from"`
+		Height int64  `csv:"height"`
+		Memo   string `csv:"-"`
+	}
+	query, err := csvCopyQuery("testing.transactions", reflect.TypeOf(&csvTx{}))
+	assert.NoError(t, err)
+	assert.Equal(t, `COPY "testing"."transactions" ("tx_from", "height") FROM STDIN WITH (FORMAT csv, HEADER true)`, query)
+}
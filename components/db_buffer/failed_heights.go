@@ -0,0 +1,104 @@
+package db_buffer
+
+import (
+	"sort"
+
+	"github.com/Zondax/zindexer/components/tracker"
+	"go.uber.org/zap"
+)
+
+// RequeueFn re-enqueues heights whose data could not be synced, so they are processed again
+type RequeueFn func(heights []uint64)
+
+// SetRequeueFunc sets the function receiving the heights reported in SyncResult.FailedHeights, and the ones whose
+// data is dropped after a failed sync. If none is set, their in-progress marks are removed for SyncResult.Id, so
+// they are fetched again as missing heights
+func (b *Buffer) SetRequeueFunc(fn RequeueFn) {
+	b.requeueFn = fn
+}
+
+// removeFailedHeights makes sure the heights reported as failed are not tracked as synced
+func (r *SyncResult) removeFailedHeights() {
+	if len(r.FailedHeights) == 0 || r.SyncedHeights == nil {
+		return
+	}
+
+	synced := make([]uint64, 0, len(*r.SyncedHeights))
+	for _, h := range *r.SyncedHeights {
+		if _, failed := r.FailedHeights[h]; !failed {
+			synced = append(synced, h)
+		}
+	}
+	r.SyncedHeights = &synced
+}
+
+// onFailedHeights reports and re-enqueues the heights which failed in a sync that succeeded for the rest
+func (b *Buffer) onFailedHeights(g *syncGroup, r *SyncResult) {
+	if r.Error != nil || len(r.FailedHeights) == 0 {
+		return
+	}
+
+	heights := make([]uint64, 0, len(r.FailedHeights))
+	for h, reason := range r.FailedHeights {
+		zap.S().Warnf("[Buffer] height %d could not be synced: %v", h, reason)
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	getMetrics().failedHeights.WithLabelValues(b.name, g.label()).Add(float64(len(heights)))
+
+	if b.requeueFn != nil {
+		b.requeueFn(heights)
+		return
+	}
+
+	if r.Id == "" {
+		return
+	}
+
+	if err := tracker.UpdateInProgressHeight(false, &heights, r.Id, b.dbConn); err != nil {
+		zap.S().Errorf("[Buffer] could not release failed heights: %v", err)
+	}
+}
+
+// releaseDropped re-enqueues the heights of the sync of g whose data is dropped after a failure, along with the
+// ones reported in r.SyncedHeights, as a failing callback usually reports none
+func (b *Buffer) releaseDropped(g *syncGroup, r *SyncResult) {
+	if g.syncing == nil {
+		return
+	}
+
+	dropped := make(map[uint64]bool)
+	for _, h := range g.syncing.heights() {
+		dropped[h] = true
+	}
+	if r.SyncedHeights != nil {
+		for _, h := range *r.SyncedHeights {
+			dropped[h] = true
+		}
+	}
+
+	if len(dropped) == 0 {
+		return
+	}
+
+	heights := make([]uint64, 0, len(dropped))
+	for h := range dropped {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	if b.requeueFn != nil {
+		b.requeueFn(heights)
+		return
+	}
+
+	if r.Id == "" || b.dbConn == nil {
+		zap.S().Warnf("[Buffer] heights %v of %s were dropped, but no tracker id is known to release them", heights, g.name())
+		return
+	}
+
+	if err := tracker.UpdateInProgressHeight(false, &heights, r.Id, b.dbConn); err != nil {
+		zap.S().Errorf("[Buffer] could not release dropped heights: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package db_buffer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FailedHeights(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 3,
+	})
+
+	requeued := make(chan []uint64, 1)
+	buffer.SetRequeueFunc(func(heights []uint64) {
+		requeued <- heights
+	})
+
+	buffer.SetSyncFunc(func() SyncResult {
+		return SyncResult{
+			SyncedHeights: &[]uint64{0, 1, 2, 3},
+			FailedHeights: map[uint64]error{3: fmt.Errorf("constraint violation"), 1: fmt.Errorf("timeout")},
+		}
+	})
+	buffer.Start()
+	defer buffer.Stop()
+
+	for h := 0; h < 3; h++ {
+		assert.NoError(t, buffer.InsertData("transaction", int64(h), createMockTx(h), true))
+	}
+
+	assert.Equal(t, []uint64{1, 3}, <-requeued)
+
+	result := <-buffer.SyncComplete
+	result.removeFailedHeights()
+	assert.Equal(t, []uint64{0, 2}, *result.SyncedHeights)
+}
@@ -0,0 +1,92 @@
+package db_buffer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultFlushTimeout = 30 * time.Second
+
+// flush runs a last sync of the groups with buffered data, in parallel, waiting for them at most timeout.
+// A sync still running at the deadline is not cancelled, but its outcome is not waited for. The returned
+// channel is closed once all the syncs finished
+func (b *Buffer) flush(groups []*syncGroup, timeout time.Duration) (<-chan struct{}, error) {
+	results := make(chan error, len(groups))
+	var running sync.WaitGroup
+	pending := 0
+	for _, g := range groups {
+		if !b.hasData(g) {
+			continue
+		}
+
+		pending++
+		running.Add(1)
+		go func(g *syncGroup) {
+			defer running.Done()
+			zap.S().Infof("[Buffer] flushing %s before stopping...", g.name())
+			b.observeTrigger(g, triggerStop)
+			if err := b.callSync(g); err != nil {
+				results <- fmt.Errorf("flush of %s failed: %w", g.name(), err)
+				return
+			}
+			results <- nil
+		}(g)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var errs []error
+	timedOut := false
+wait:
+	for received := 0; received < pending; received++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err)
+			}
+		case <-deadline.C:
+			errs = append(errs, fmt.Errorf("flush did not finish within %s, %d syncs still running", timeout, pending-received))
+			timedOut = true
+			break wait
+		}
+	}
+
+	done := make(chan struct{})
+	if timedOut {
+		go func() {
+			running.Wait()
+			close(done)
+		}()
+	} else {
+		running.Wait()
+		close(done)
+	}
+
+	err := errors.Join(errs...)
+	if err != nil {
+		zap.S().Errorf("[Buffer] %v", err)
+		return done, err
+	}
+
+	zap.S().Infof("[Buffer] flush done")
+	return done, nil
+}
+
+// hasData returns whether any key of g holds data not synced yet
+func (b *Buffer) hasData(g *syncGroup) bool {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	for key, m := range b.buffer {
+		if b.groupOf(key) == g && m.Count() > 0 {
+			return true
+		}
+	}
+
+	return false
+}
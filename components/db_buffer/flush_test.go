@@ -0,0 +1,90 @@
+package db_buffer
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FlushOnStop(t *testing.T) {
+	tests := []struct {
+		name      string
+		syncErr   error
+		syncDelay time.Duration
+		wantError bool
+	}{
+		{"flushed", nil, 0, false},
+		{"sync failure", fmt.Errorf("db is down"), 0, true},
+		{"deadline", nil, time.Second, true},
+	}
+
+	for _, tt := range tests {
+		buffer := NewDBBuffer(nil, Config{
+			SyncTimePeriod:     TestTimeout,
+			SyncBlockThreshold: 100,
+			FlushOnStop:        true,
+			FlushTimeout:       100 * time.Millisecond,
+		})
+
+		// keys without data are not flushed
+		buffer.SetKeySyncFunc("empty", func() SyncResult {
+			t.Errorf("%s: key without data flushed", tt.name)
+			return SyncResult{}
+		}, KeyConfig{})
+
+		flushed := make(chan int, 1)
+		buffer.SetSyncFunc(func() SyncResult {
+			flushed <- buffer.GetBufferSize("transaction")
+			time.Sleep(tt.syncDelay)
+			return SyncResult{Error: tt.syncErr}
+		})
+		buffer.Start()
+
+		for h := 0; h < 3; h++ {
+			assert.NoError(t, buffer.InsertData("transaction", int64(h), createMockTx(h), false))
+		}
+
+		err := buffer.Stop()
+		assert.Equal(t, tt.wantError, err != nil, "%s: %v", tt.name, err)
+		assert.Equal(t, 3, <-flushed, tt.name)
+	}
+}
+
+func Test_StopAfterFlushDeadline(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     20 * time.Millisecond,
+		SyncBlockThreshold: 100,
+		FlushOnStop:        true,
+		FlushTimeout:       10 * time.Millisecond,
+		WalDir:             t.TempDir(),
+	})
+	assert.NoError(t, buffer.RegisterKeyType("transaction", ReportTransaction{}))
+
+	synced := make(chan struct{})
+	buffer.SetSyncFunc(func() SyncResult {
+		time.Sleep(100 * time.Millisecond)
+		close(synced)
+		return SyncResult{}
+	})
+	buffer.defaultGroup.syncTicker.Reset(time.Hour)
+	buffer.Start()
+	assert.NoError(t, buffer.InsertData("transaction", 0, createMockTx(0), false))
+
+	// the flush sync goes on after Stop returned, the WAL and the ticker are released once it finishes
+	assert.Error(t, buffer.Stop())
+	<-synced
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(buffer.wal.segmentPath("transaction"))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-buffer.defaultGroup.syncTicker.C:
+		t.Error("the ticker was reset after Stop")
+	default:
+	}
+}
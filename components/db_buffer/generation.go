@@ -0,0 +1,167 @@
+package db_buffer
+
+import (
+	"strconv"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"go.uber.org/zap"
+)
+
+// generation is the data of the keys of a sync group taken when a sync starts. Inserts made while
+// it is being synced go to fresh maps, so they do not wait for the sync
+type generation struct {
+	maps  map[string]cmap.ConcurrentMap
+	usage map[string]usage
+	next  int64 // in Ordered mode, the next height once synced, -1 if it does not move
+	// replaced are the heights of each key replaced while being synced, which replace the data synced if it fails
+	replaced map[string]map[string]bool
+}
+
+// heights returns the heights with data in gen
+func (gen *generation) heights() []uint64 {
+	var heights []uint64
+	for _, m := range gen.maps {
+		for _, heightKey := range m.Keys() {
+			if h, err := strconv.ParseUint(heightKey, 10, 64); err == nil {
+				heights = append(heights, h)
+			}
+		}
+	}
+
+	return heights
+}
+
+// swapGeneration hands the data of the keys of g to its sync, and starts a new generation for the inserts
+func (b *Buffer) swapGeneration(g *syncGroup) {
+	g.insertMutex.Lock()
+	defer g.insertMutex.Unlock()
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	gen := &generation{
+		maps:  make(map[string]cmap.ConcurrentMap),
+		usage: make(map[string]usage),
+		next:  -1,
+	}
+
+	for key, m := range b.buffer {
+		if b.groupOf(key) != g {
+			continue
+		}
+
+		gen.maps[key] = m
+		gen.usage[key] = b.budget.detach(key)
+		b.buffer[key] = cmap.New()
+
+		if b.wal != nil {
+			if err := b.wal.rotate(key); err != nil {
+				zap.S().Errorf("[Buffer] could not rotate WAL of key %s: %v", key, err)
+			}
+		}
+	}
+
+	g.syncing = gen
+}
+
+// restoreGeneration merges the data of the failed sync of g back into the buffer, before the data inserted since.
+// Heights replaced during the sync keep the new data only, as the WAL replays them
+func (b *Buffer) restoreGeneration(g *syncGroup) {
+	g.insertMutex.Lock()
+	defer g.insertMutex.Unlock()
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	if g.syncing == nil {
+		return
+	}
+
+	syncing := g.syncing
+	g.syncing = nil
+
+	for key, m := range syncing.maps {
+		b.budget.attach(key, syncing.usage[key])
+
+		if newer, ok := b.buffer[key]; ok {
+			for heightKey, data := range newer.Items() {
+				old, exists := m.Get(heightKey)
+				merged, err := mergeHeightData(old, exists, data, syncing.replaced[key][heightKey])
+				if err != nil {
+					// a value inserted again during the sync replaces the one which failed
+					merged = data
+				}
+
+				m.Set(heightKey, merged)
+				if exists {
+					b.accountMerge(key, old, estimateSize(data), merged)
+				}
+			}
+		}
+		b.buffer[key] = m
+		b.setItemsMetric(key)
+
+		if b.wal != nil {
+			if err := b.wal.restore(key); err != nil {
+				zap.S().Errorf("[Buffer] could not restore WAL of key %s: %v", key, err)
+			}
+		}
+	}
+
+	b.updateFullnessMetric()
+}
+
+// dropGeneration releases the data of the sync of g, once synced or dropped after a failure
+func (b *Buffer) dropGeneration(g *syncGroup) {
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	if g.syncing == nil {
+		return
+	}
+
+	syncing := g.syncing
+	g.syncing = nil
+
+	for key, u := range syncing.usage {
+		b.budget.releaseUsage(u)
+		b.setItemsMetric(key)
+
+		if b.wal != nil {
+			if err := b.wal.removeSegment(key); err != nil {
+				zap.S().Errorf("[Buffer] could not remove WAL segment of key %s: %v", key, err)
+			}
+		}
+	}
+
+	b.updateFullnessMetric()
+}
+
+// markReplaced records that height of key was replaced while g is being synced
+func (b *Buffer) markReplaced(g *syncGroup, key string, heightKey string) {
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	if g.syncing == nil {
+		return
+	}
+
+	if g.syncing.replaced == nil {
+		g.syncing.replaced = make(map[string]map[string]bool)
+	}
+	if g.syncing.replaced[key] == nil {
+		g.syncing.replaced[key] = make(map[string]bool)
+	}
+	g.syncing.replaced[key][heightKey] = true
+}
+
+// acquireSyncSlot waits until less than MaxSyncsInFlight syncs are in progress
+func (b *Buffer) acquireSyncSlot() {
+	if b.syncSlots != nil {
+		b.syncSlots <- struct{}{}
+	}
+}
+
+func (b *Buffer) releaseSyncSlot() {
+	if b.syncSlots != nil {
+		<-b.syncSlots
+	}
+}
@@ -0,0 +1,160 @@
+package db_buffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingSync returns a sync function which reports the data it got on started and waits for release
+func blockingSync(t *testing.T, txsBuffer *TypedBuffer[ReportTransaction], started chan []uint64, release chan error) SyncCB {
+	return func() SyncResult {
+		_, heights, err := txsBuffer.GetItems()
+		assert.NoError(t, err)
+		started <- heights
+		return SyncResult{Error: <-release}
+	}
+}
+
+func Test_InsertDuringSync(t *testing.T) {
+	for _, syncErr := range []error{nil, fmt.Errorf("db is down")} {
+		dir := t.TempDir()
+		buffer := NewDBBuffer(nil, Config{
+			SyncTimePeriod:     TestTimeout,
+			SyncBlockThreshold: 1,
+			RetryBackoff:       TestTimeout,
+			WalDir:             dir,
+		})
+		txsBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "transaction")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		started, release := make(chan []uint64), make(chan error)
+		buffer.SetSyncFunc(blockingSync(t, txsBuffer, started, release))
+		buffer.Start()
+
+		assert.NoError(t, txsBuffer.InsertData(1, []ReportTransaction{createMockTx(1)}, true))
+		assert.Equal(t, []uint64{1}, <-started)
+
+		// inserts do not wait for the sync in progress, which does not see them
+		inserted := make(chan error)
+		go func() {
+			if err := txsBuffer.InsertData(1, []ReportTransaction{createMockTx(1)}, false); err != nil {
+				inserted <- err
+				return
+			}
+			inserted <- txsBuffer.InsertData(2, []ReportTransaction{createMockTx(2)}, false)
+		}()
+		select {
+		case err = <-inserted:
+			assert.NoError(t, err)
+		case <-time.After(TestSyncPeriod):
+			t.Fatal("insert blocked by the sync")
+		}
+		assert.Equal(t, 1, buffer.GetBufferSize("transaction"))
+
+		release <- syncErr
+		<-buffer.SyncComplete
+		buffer.Stop()
+
+		data, err := txsBuffer.GetData()
+		assert.NoError(t, err)
+		if syncErr == nil {
+			assert.Len(t, data[1], 1)
+			assert.Equal(t, 2, buffer.budget.total.items)
+		} else {
+			// the data of the failed sync is merged back before the data inserted since
+			assert.Len(t, data[1], 2)
+			assert.Equal(t, 2, buffer.budget.total.items)
+		}
+		assert.Len(t, data[2], 1)
+
+		replayBuffer, replayTxsBuffer := newWalBuffer(t, dir)
+		_, err = replayBuffer.ReplayWAL()
+		assert.NoError(t, err)
+		replayed, err := replayTxsBuffer.GetData()
+		assert.NoError(t, err)
+		assert.Equal(t, data, replayed)
+	}
+}
+
+func Test_ReplaceDuringFailedSync(t *testing.T) {
+	dir := t.TempDir()
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 1,
+		RetryBackoff:       TestTimeout,
+		WalDir:             dir,
+	})
+	txsBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "transaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan []uint64), make(chan error)
+	buffer.SetSyncFunc(blockingSync(t, txsBuffer, started, release))
+	buffer.Start()
+
+	assert.NoError(t, txsBuffer.InsertData(1, []ReportTransaction{createMockTx(1), createMockTx(1)}, true))
+	assert.Equal(t, []uint64{1}, <-started)
+
+	// a height replaced during a sync which fails replaces the data of the sync
+	replaced := []ReportTransaction{createMockTx(1)}
+	assert.NoError(t, txsBuffer.ReplaceHeight(1, replaced, false))
+
+	release <- fmt.Errorf("db is down")
+	<-buffer.SyncComplete
+	buffer.Stop()
+
+	data, err := txsBuffer.GetData()
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64][]ReportTransaction{1: replaced}, data)
+	assert.Equal(t, 1, buffer.budget.total.items)
+
+	replayBuffer, replayTxsBuffer := newWalBuffer(t, dir)
+	_, err = replayBuffer.ReplayWAL()
+	assert.NoError(t, err)
+	replayed, err := replayTxsBuffer.GetData()
+	assert.NoError(t, err)
+	assert.Equal(t, data, replayed)
+}
+
+func Test_MaxSyncsInFlight(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 1,
+		MaxSyncsInFlight:   1,
+	})
+	txsBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "transaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocksBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan []uint64), make(chan error)
+	buffer.SetSyncFunc(blockingSync(t, txsBuffer, started, release))
+	buffer.SetKeySyncFunc("block", blockingSync(t, blocksBuffer, started, release), KeyConfig{})
+	buffer.Start()
+	defer buffer.Stop()
+
+	assert.NoError(t, txsBuffer.InsertData(1, []ReportTransaction{createMockTx(1)}, true))
+	assert.NoError(t, blocksBuffer.InsertData(2, []ReportTransaction{createMockTx(2)}, true))
+
+	first := <-started
+	select {
+	case <-started:
+		t.Fatal("a second sync started while the first one is in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release <- nil
+	second := <-started
+	release <- nil
+	assert.ElementsMatch(t, [][]uint64{{1}, {2}}, [][]uint64{first, second})
+}
@@ -0,0 +1,250 @@
+package db_buffer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const DefaultSinkBatchSize = 1000
+
+// ConflictPolicy defines how the gorm sink handles rows which already exist in the table
+type ConflictPolicy int
+
+const (
+	// ConflictError fails the sync, as a plain insert does
+	ConflictError ConflictPolicy = iota
+	// ConflictIgnore skips the existing rows (ON CONFLICT DO NOTHING)
+	ConflictIgnore
+	// ConflictUpsert updates the existing rows (ON CONFLICT DO UPDATE)
+	ConflictUpsert
+)
+
+// ConvertFn converts the data buffered for a height into the model rows written to the table.
+// It can return a single model or a slice of them
+type ConvertFn func(height int64, data interface{}) (interface{}, error)
+
+// SinkTable maps the data under a buffer key to a table
+type SinkTable struct {
+	Key string
+	// Table overrides the table name of the model
+	Table string
+	// Convert is needed when the buffered data is not the model itself, or a slice of it
+	Convert ConvertFn
+	// BatchSize defaults to the sink batch size
+	BatchSize int
+	// OnConflict defines how rows which already exist are handled
+	OnConflict ConflictPolicy
+	// ConflictColumns is the conflict target of ConflictIgnore and ConflictUpsert. Empty means the primary key
+	// columns of the model
+	ConflictColumns []string
+	// UpdateColumns are the columns updated by ConflictUpsert. Empty means all of them
+	UpdateColumns []string
+}
+
+// GormSink is a ready-made sync callback which writes the data under the keys of its tables with gorm,
+// and reports the heights it wrote as synced. Tables are written in the order they are given, so
+// referenced tables must come first. All the keys should belong to the sync callback the sink is set on
+type GormSink struct {
+	buffer    *Buffer
+	id        string
+	tables    []SinkTable
+	batchSize int
+}
+
+// NewGormSink returns a sink writing the data of buffer b for the indexer id. A batchSize of 0 uses DefaultSinkBatchSize
+func NewGormSink(b *Buffer, id string, batchSize int, tables ...SinkTable) *GormSink {
+	if batchSize <= 0 {
+		batchSize = DefaultSinkBatchSize
+	}
+
+	return &GormSink{
+		buffer:    b,
+		id:        id,
+		tables:    tables,
+		batchSize: batchSize,
+	}
+}
+
+// Sync writes the buffered data in a transaction of the buffer database connection, so the tables are not left
+// partially written when the sync fails. It can be set with SetSyncFunc
+func (s *GormSink) Sync() SyncResult {
+	if s.buffer.dbConn == nil {
+		return s.write(nil)
+	}
+
+	var result SyncResult
+	err := s.buffer.dbConn.Transaction(func(tx *gorm.DB) error {
+		result = s.write(tx)
+		return result.Error
+	})
+	if err != nil && result.Error == nil {
+		// the commit failed
+		result = SyncResult{Id: s.id, Error: err}
+	}
+
+	return result
+}
+
+// SyncTx writes the buffered data using tx. It can be set with SetTxSyncFunc, so the synced heights are
+// tracked in the same transaction
+func (s *GormSink) SyncTx(tx *gorm.DB) SyncResult {
+	return s.write(tx)
+}
+
+func (s *GormSink) write(db *gorm.DB) SyncResult {
+	if db == nil {
+		return SyncResult{Id: s.id, Error: fmt.Errorf("gorm sink requires a database connection")}
+	}
+
+	heights := make(map[uint64]bool)
+	for _, table := range s.tables {
+		if err := s.writeTable(db, table, heights); err != nil {
+			return SyncResult{Id: s.id, Error: err}
+		}
+	}
+
+	synced := make([]uint64, 0, len(heights))
+	for h := range heights {
+		synced = append(synced, h)
+	}
+	sort.Slice(synced, func(i, j int) bool { return synced[i] < synced[j] })
+
+	return SyncResult{Id: s.id, SyncedHeights: &synced}
+}
+
+// writeTable inserts the rows of the key of table, in ascending height order, and adds their heights to heights
+func (s *GormSink) writeTable(db *gorm.DB, table SinkTable, heights map[uint64]bool) error {
+	m, ok := s.buffer.getMap(table.Key)
+	if !ok {
+		return nil
+	}
+
+	data := make(map[int64]interface{})
+	for k, v := range m.Items() {
+		height, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return fmt.Errorf("[Buffer] invalid height '%s' for key %s: %w", k, table.Key, err)
+		}
+		data[height] = v
+	}
+
+	sorted := make([]int64, 0, len(data))
+	for h := range data {
+		sorted = append(sorted, h)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var rows reflect.Value
+	for _, height := range sorted {
+		value := data[height]
+		if table.Convert != nil {
+			converted, err := table.Convert(height, value)
+			if err != nil {
+				return fmt.Errorf("[Buffer] could not convert data of key %s, height %d: %w", table.Key, height, err)
+			}
+			value = converted
+		}
+
+		var err error
+		if rows, err = appendRows(rows, value); err != nil {
+			return fmt.Errorf("[Buffer] key %s, height %d: %w", table.Key, height, err)
+		}
+		heights[uint64(height)] = true
+	}
+
+	if !rows.IsValid() || rows.Len() == 0 {
+		return nil
+	}
+
+	query := db
+	if table.Table != "" {
+		query = query.Table(table.Table)
+	}
+	conflict, ok, err := onConflictClause(db, table, rows.Type().Elem())
+	if err != nil {
+		return fmt.Errorf("[Buffer] key %s: %w", table.Key, err)
+	}
+	if ok {
+		query = query.Clauses(conflict)
+	}
+
+	batchSize := table.BatchSize
+	if batchSize <= 0 {
+		batchSize = s.batchSize
+	}
+
+	if err := query.CreateInBatches(rows.Interface(), batchSize).Error; err != nil {
+		zap.S().Errorf("[Buffer] could not write %d rows of key %s: %v", rows.Len(), table.Key, err)
+		return err
+	}
+
+	zap.S().Debugf("[Buffer] wrote %d rows of key %s", rows.Len(), table.Key)
+	return nil
+}
+
+// appendRows appends value, a single row or a slice of them, to rows. rows is created with the type of the first row
+func appendRows(rows reflect.Value, value interface{}) (reflect.Value, error) {
+	if value == nil {
+		return rows, nil
+	}
+
+	v := reflect.ValueOf(value)
+	rowType := v.Type()
+	if v.Kind() == reflect.Slice {
+		rowType = v.Type().Elem()
+	}
+
+	if !rows.IsValid() {
+		rows = reflect.MakeSlice(reflect.SliceOf(rowType), 0, 0)
+	}
+	if rows.Type().Elem() != rowType {
+		return rows, fmt.Errorf("unexpected row type %s, expected %s", rowType, rows.Type().Elem())
+	}
+
+	if v.Kind() == reflect.Slice {
+		return reflect.AppendSlice(rows, v), nil
+	}
+
+	return reflect.Append(rows, v), nil
+}
+
+// onConflictClause returns the ON CONFLICT clause of table, whose rows are of type rowType. Without
+// ConflictColumns, the target is the primary key of the model, as ON CONFLICT DO UPDATE requires one
+func onConflictClause(db *gorm.DB, table SinkTable, rowType reflect.Type) (clause.OnConflict, bool, error) {
+	if table.OnConflict != ConflictIgnore && table.OnConflict != ConflictUpsert {
+		return clause.OnConflict{}, false, nil
+	}
+
+	var columns []clause.Column
+	for _, c := range table.ConflictColumns {
+		columns = append(columns, clause.Column{Name: c})
+	}
+
+	if len(columns) == 0 {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(reflect.New(rowType).Interface()); err != nil {
+			return clause.OnConflict{}, false, fmt.Errorf("could not parse model %s: %w", rowType, err)
+		}
+
+		for _, f := range stmt.Schema.PrimaryFields {
+			columns = append(columns, clause.Column{Name: f.DBName})
+		}
+		if len(columns) == 0 && table.OnConflict == ConflictUpsert {
+			return clause.OnConflict{}, false, fmt.Errorf("model %s has no primary key to upsert on, set ConflictColumns", rowType)
+		}
+	}
+
+	if table.OnConflict == ConflictIgnore {
+		return clause.OnConflict{Columns: columns, DoNothing: true}, true, nil
+	}
+	if len(table.UpdateColumns) == 0 {
+		return clause.OnConflict{Columns: columns, UpdateAll: true}, true, nil
+	}
+	return clause.OnConflict{Columns: columns, DoUpdates: clause.AssignmentColumns(table.UpdateColumns)}, true, nil
+}
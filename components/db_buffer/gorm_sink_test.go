@@ -0,0 +1,70 @@
+package db_buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type sinkBlock struct {
+	Height int64 `gorm:"primaryKey"`
+	Hash   string
+}
+
+func Test_GormSink(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 100,
+	})
+	buffer.Start()
+	defer buffer.Stop()
+
+	assert.NoError(t, buffer.InsertData("block", 2, sinkBlock{Height: 2}, false))
+	assert.NoError(t, buffer.InsertData("block", 1, sinkBlock{Height: 1}, false))
+	for _, h := range []int64{3, 1} {
+		assert.NoError(t, buffer.InsertData("transaction", h, []ReportTransaction{createMockTx(int(h)), createMockTx(int(h))}, false))
+	}
+
+	// statements are not executed, only recorded
+	var statements []string
+	db := unreachableDB(t).Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true})
+	err := db.Callback().Create().After("gorm:create").Register("test:record", func(d *gorm.DB) {
+		statements = append(statements, d.Statement.SQL.String())
+	})
+	assert.NoError(t, err)
+
+	sink := NewGormSink(buffer, "test", 3,
+		SinkTable{Key: "block", OnConflict: ConflictIgnore},
+		SinkTable{Key: "transaction", Table: "txs", OnConflict: ConflictUpsert, ConflictColumns: []string{"height"},
+			UpdateColumns: []string{"tx_from"}},
+		SinkTable{Key: "missing"},
+	)
+
+	result := sink.SyncTx(db)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "test", result.Id)
+	assert.Equal(t, []uint64{1, 2, 3}, *result.SyncedHeights)
+
+	// blocks first, then the 4 transactions in batches of 3
+	assert.Len(t, statements, 3)
+	assert.Contains(t, statements[0], `INSERT INTO "sink_blocks"`)
+	assert.Contains(t, statements[0], `ON CONFLICT ("height") DO NOTHING`)
+	assert.Contains(t, statements[1], `INSERT INTO "txs"`)
+	assert.Contains(t, statements[1], `ON CONFLICT ("height") DO UPDATE SET "tx_from"="excluded"."tx_from"`)
+
+	// without conflict columns, upserts target the primary key of the model
+	statements = nil
+	sink = NewGormSink(buffer, "test", 3, SinkTable{Key: "block", OnConflict: ConflictUpsert, UpdateColumns: []string{"hash"}})
+	assert.NoError(t, sink.SyncTx(db).Error)
+	assert.Len(t, statements, 1)
+	assert.Contains(t, statements[0], `ON CONFLICT ("height") DO UPDATE SET "hash"="excluded"."hash"`)
+
+	assert.Error(t, sink.Sync().Error, "the buffer has no database connection")
+
+	// Sync writes in a transaction, so nothing is written when it cannot begin
+	statements = nil
+	buffer.dbConn = db
+	assert.Error(t, sink.Sync().Error)
+	assert.Empty(t, statements)
+}
@@ -0,0 +1,176 @@
+package db_buffer
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Zondax/zindexer/components/connections/zmetrics"
+	"go.uber.org/zap"
+)
+
+const DefaultBufferName = "default"
+
+// Reasons a sync is triggered for
+const (
+	triggerTicker    = "ticker"
+	triggerThreshold = "threshold"
+	triggerFull      = "full"
+	triggerStop      = "stop"
+)
+
+var defaultBucketTime = []float64{1, 5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60}
+
+// bufferMetrics are shared by all the buffers, labelled by buffer name. Key metrics are labelled by key,
+// sync metrics by the keys of the sync callback: its key, or "default" for the default callback
+type bufferMetrics struct {
+	syncTime            zmetrics.HistogramVec
+	syncs               zmetrics.CounterVec
+	syncTriggers        zmetrics.CounterVec
+	consecutiveFailures zmetrics.GaugeVec
+	failedHeights       zmetrics.CounterVec
+	lastSuccess         zmetrics.GaugeVec
+	fullness            zmetrics.GaugeVec
+	items               zmetrics.GaugeVec
+	inserts             zmetrics.CounterVec
+	rowsWritten         zmetrics.CounterVec
+	gapSeconds          zmetrics.GaugeVec
+	gapTimeouts         zmetrics.CounterVec
+	staleHeights        zmetrics.CounterVec
+	halted              zmetrics.GaugeVec
+}
+
+var (
+	metrics     bufferMetrics
+	metricsOnce sync.Once
+)
+
+func getMetrics() *bufferMetrics {
+	metricsOnce.Do(registerMetrics)
+	return &metrics
+}
+
+// observeSync records the outcome of a sync of g which took the given time
+func (b *Buffer) observeSync(g *syncGroup, err error, took time.Duration) {
+	m := getMetrics()
+	if err != nil {
+		m.syncs.WithLabelValues(b.name, g.label(), "failure").Inc()
+		return
+	}
+
+	m.syncs.WithLabelValues(b.name, g.label(), "success").Inc()
+	m.syncTime.WithLabelValues(b.name, g.label()).Observe(took.Seconds())
+	m.lastSuccess.WithLabelValues(b.name, g.label()).Set(float64(time.Now().Unix()))
+}
+
+func (b *Buffer) observeTrigger(g *syncGroup, reason string) {
+	getMetrics().syncTriggers.WithLabelValues(b.name, g.label(), reason).Inc()
+}
+
+func (b *Buffer) observeInsert(key string) {
+	getMetrics().inserts.WithLabelValues(b.name, key).Inc()
+}
+
+// observeRowsWritten counts the rows of a synced generation: the items of slices, or 1 for other values
+func (b *Buffer) observeRowsWritten(gen *generation) {
+	for key, m := range gen.maps {
+		var rows int
+		for _, data := range m.Items() {
+			if isSlice(data) {
+				rows += reflect.ValueOf(data).Len()
+			} else {
+				rows++
+			}
+		}
+		getMetrics().rowsWritten.WithLabelValues(b.name, key).Add(float64(rows))
+	}
+}
+
+func (b *Buffer) updateFailuresMetric(g *syncGroup) {
+	getMetrics().consecutiveFailures.WithLabelValues(b.name, g.label()).Set(float64(g.status().ConsecutiveFailures))
+}
+
+func (b *Buffer) updateFullnessMetric() {
+	getMetrics().fullness.WithLabelValues(b.name).Set(b.budget.fullness())
+}
+
+// updateItemsMetric updates the heights buffered under key, being synced or not
+func (b *Buffer) updateItemsMetric(key string) {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	b.setItemsMetric(key)
+}
+
+// setItemsMetric is updateItemsMetric for callers holding keysMutex
+func (b *Buffer) setItemsMetric(key string) {
+	var items int
+	if m, ok := b.buffer[key]; ok {
+		items += m.Count()
+	}
+	if g := b.groupOf(key); g.syncing != nil {
+		if m, ok := g.syncing.maps[key]; ok {
+			items += m.Count()
+		}
+	}
+
+	getMetrics().items.WithLabelValues(b.name, key).Set(float64(items))
+}
+
+func registerMetrics() {
+	register := func(name string, c zmetrics.PrometheusCollector) {
+		if err := zmetrics.RegisterMetric(c); err != nil {
+			zap.S().Errorf("Could not register Metric: %s", name)
+		}
+	}
+
+	newCounter := func(name, help string, labels ...string) zmetrics.CounterVec {
+		c := zmetrics.NewVecCounter(zmetrics.CounterOpts{
+			Namespace: "blocks",
+			Subsystem: "buffer",
+			Name:      name,
+			Help:      help,
+		}, append([]string{"buffer"}, labels...))
+
+		register(name, c)
+		return c
+	}
+
+	newGauge := func(name, help string, labels ...string) zmetrics.GaugeVec {
+		g := zmetrics.NewVecGauge(zmetrics.GaugeOpts{
+			Namespace: "blocks",
+			Subsystem: "buffer",
+			Name:      name,
+			Help:      help,
+		}, append([]string{"buffer"}, labels...))
+
+		register(name, g)
+		return g
+	}
+
+	syncTime := zmetrics.NewVecHistogram(zmetrics.HistogramOpts{
+		Namespace: "blocks",
+		Subsystem: "buffer",
+		Name:      "sync_total_time_seconds",
+		Help:      "Total time spent by successful syncs",
+		Buckets:   defaultBucketTime,
+	}, []string{"buffer", "keys"})
+	register("sync_total_time_seconds", syncTime)
+
+	metrics = bufferMetrics{
+		syncTime:            syncTime,
+		syncs:               newCounter("syncs_total", "Syncs by result: success or failure", "keys", "result"),
+		syncTriggers:        newCounter("sync_triggers_total", "Syncs triggered by reason: ticker, threshold, full or stop", "keys", "reason"),
+		consecutiveFailures: newGauge("consecutive_sync_failures", "Consecutive failed syncs", "keys"),
+		failedHeights:       newCounter("failed_heights_total", "Heights reported as failed by syncs which succeeded for the rest", "keys"),
+		lastSuccess:         newGauge("last_successful_sync_timestamp_seconds", "Unix time of the last successful sync. The time since is time() minus it", "keys"),
+		fullness:            newGauge("fullness_ratio", "Fraction of the buffer budget (MaxItems or MaxBytes) in use"),
+		items:               newGauge("items", "Heights buffered, including the ones being synced", "key"),
+		inserts:             newCounter("inserts_total", "Inserts. Its rate is the insert rate", "key"),
+		rowsWritten:         newCounter("rows_written_total", "Rows synced: the items of the buffered slices, or 1 per height for other values", "key"),
+		gapSeconds:          newGauge("ordered_gap_seconds", "Time a missing height has been holding back buffered heights, in Ordered mode", "keys"),
+		gapTimeouts:         newCounter("ordered_gap_timeouts_total", "Gaps which persisted longer than GapTimeout, in Ordered mode", "keys"),
+		staleHeights:        newCounter("ordered_stale_heights_total", "Heights synced out of order for being below the next height, in Ordered mode", "keys"),
+		halted:              newGauge("halted", "1 once a sync failure halted the buffer, see SyncFailureHalt"),
+	}
+}
@@ -0,0 +1,43 @@
+package db_buffer
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Metrics(t *testing.T) {
+	// buffers share the metrics, labelled by name
+	other := NewDBBuffer(nil, Config{Name: "metrics-other", SyncTimePeriod: TestTimeout})
+	buffer := NewDBBuffer(nil, Config{
+		Name:               "metrics",
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 2,
+	})
+
+	buffer.SetSyncFunc(func() SyncResult {
+		return SyncResult{}
+	})
+	buffer.Start()
+	defer buffer.Stop()
+	other.Start()
+	defer other.Stop()
+
+	m := getMetrics()
+	assert.NoError(t, buffer.InsertData("transaction", 1, []ReportTransaction{createMockTx(1), createMockTx(1)}, true))
+	assert.NoError(t, other.InsertData("transaction", 1, createMockTx(1), false))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.items.WithLabelValues("metrics", "transaction")))
+
+	assert.NoError(t, buffer.InsertData("transaction", 2, []ReportTransaction{createMockTx(2)}, true))
+	assert.NoError(t, (<-buffer.SyncComplete).Error)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.inserts.WithLabelValues("metrics", "transaction")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.inserts.WithLabelValues("metrics-other", "transaction")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.syncTriggers.WithLabelValues("metrics", "default", triggerThreshold)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.syncs.WithLabelValues("metrics", "default", "success")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.rowsWritten.WithLabelValues("metrics", "transaction")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.items.WithLabelValues("metrics", "transaction")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.items.WithLabelValues("metrics-other", "transaction")))
+	assert.Greater(t, testutil.ToFloat64(m.lastSuccess.WithLabelValues("metrics", "default")), 0.0)
+}
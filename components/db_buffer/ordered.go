@@ -0,0 +1,259 @@
+package db_buffer
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"go.uber.org/zap"
+)
+
+const DefaultGapTimeout = 5 * time.Minute
+
+// GapAlertFn is called when the height 'height' is missing for longer than GapTimeout, holding back
+// the heights buffered above it for the sync callback of keys
+type GapAlertFn func(keys string, height int64, since time.Time)
+
+// SetNextHeight sets the height ordered syncs start from, the one after the last synced height. It never
+// moves the next height of a sync callback backwards. In Ordered mode, it must be called before Start
+func (b *Buffer) SetNextHeight(height int64) {
+	b.keysMutex.Lock()
+	if !b.hasNextHeight || height > b.nextHeight {
+		b.nextHeight, b.hasNextHeight = height, true
+	}
+	b.keysMutex.Unlock()
+
+	for _, g := range b.getGroups() {
+		g.setNextHeight(height)
+	}
+}
+
+// SetGapAlertFunc sets the function called when a gap persists in Ordered mode
+func (b *Buffer) SetGapAlertFunc(fn GapAlertFn) {
+	b.gapAlertFn = fn
+}
+
+func (g *syncGroup) setNextHeight(height int64) {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	if !g.hasNextHeight || height > g.nextHeight {
+		g.nextHeight, g.hasNextHeight = height, true
+	}
+}
+
+func (g *syncGroup) getNextHeight() (int64, bool) {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	return g.nextHeight, g.hasNextHeight
+}
+
+// orderedRun returns the heights of g to sync in Ordered mode, the contiguous run starting at the next height,
+// and the stale ones buffered below it, which are reprocessed heights or heights below the first next height.
+// It also returns the lowest missing height holding back buffered ones, -1 if none. keysMutex must be held
+func (b *Buffer) orderedRun(g *syncGroup) (map[int64]bool, map[int64]bool, int64) {
+	present := make(map[int64]bool)
+	for key, m := range b.buffer {
+		if b.groupOf(key) != g {
+			continue
+		}
+
+		for _, heightKey := range m.Keys() {
+			if height, err := strconv.ParseInt(heightKey, 10, 64); err == nil {
+				present[height] = true
+			}
+		}
+	}
+
+	run, stale := make(map[int64]bool), make(map[int64]bool)
+	next, ok := g.getNextHeight()
+	if !ok {
+		// Start requires the next height, nothing is synced without it
+		return run, stale, -1
+	}
+
+	for height := range present {
+		if height < next {
+			stale[height] = true
+		}
+	}
+	for ; present[next]; next++ {
+		run[next] = true
+	}
+
+	if len(run)+len(stale) < len(present) {
+		return run, stale, next
+	}
+	return run, stale, -1
+}
+
+// swapOrderedGeneration hands the heights of the ordered run of g to its sync, along with the stale ones, which
+// are synced out of order. The heights held back by a gap stay in the buffer, and are logged again as the WAL is
+// rotated. The stale heights are returned to be reported once the locks are released
+func (b *Buffer) swapOrderedGeneration(g *syncGroup) []int64 {
+	g.insertMutex.Lock()
+	defer g.insertMutex.Unlock()
+	b.keysMutex.Lock()
+	defer b.keysMutex.Unlock()
+
+	run, stale, gap := b.orderedRun(g)
+	gen := &generation{
+		maps:  make(map[string]cmap.ConcurrentMap),
+		usage: make(map[string]usage),
+		next:  nextOf(run),
+	}
+
+	for key, m := range b.buffer {
+		if b.groupOf(key) != g {
+			continue
+		}
+
+		synced := cmap.New()
+		var u usage
+		for heightKey, data := range m.Items() {
+			height, err := strconv.ParseInt(heightKey, 10, 64)
+			if err != nil || (!run[height] && !stale[height]) {
+				continue
+			}
+
+			synced.Set(heightKey, data)
+			m.Remove(heightKey)
+			u.items++
+			u.bytes += estimateSize(data)
+		}
+
+		gen.maps[key] = synced
+		if m.Count() == 0 {
+			gen.usage[key] = b.budget.detach(key)
+		} else {
+			gen.usage[key] = b.budget.detachPart(key, u)
+		}
+
+		b.rotateOrderedWal(key, m)
+	}
+
+	g.syncing = gen
+	g.observeGap(gap)
+
+	outOfOrder := make([]int64, 0, len(stale))
+	for h := range stale {
+		outOfOrder = append(outOfOrder, h)
+	}
+	sort.Slice(outOfOrder, func(i, j int) bool { return outOfOrder[i] < outOfOrder[j] })
+	return outOfOrder
+}
+
+// reportStale reports the heights of g synced out of order for being below its next height, through the log
+// and the ordered_stale_heights_total metric
+func (b *Buffer) reportStale(g *syncGroup, heights []int64) {
+	if len(heights) == 0 {
+		return
+	}
+
+	next, _ := g.getNextHeight()
+	zap.S().Warnf("[Buffer] heights %v of %s are below the next height %d, they are synced out of order",
+		heights, g.name(), next)
+	getMetrics().staleHeights.WithLabelValues(b.name, g.label()).Add(float64(len(heights)))
+}
+
+// rotateOrderedWal rotates the WAL of key, and logs again the data held in m
+func (b *Buffer) rotateOrderedWal(key string, m cmap.ConcurrentMap) {
+	if b.wal == nil {
+		return
+	}
+
+	if err := b.wal.rotate(key); err != nil {
+		zap.S().Errorf("[Buffer] could not rotate WAL of key %s: %v", key, err)
+		return
+	}
+
+	for heightKey, data := range m.Items() {
+		height, err := strconv.ParseInt(heightKey, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if err = b.wal.append(key, height, data, true); err != nil {
+			zap.S().Errorf("[Buffer] could not log held height %d of key %s: %v", height, key, err)
+		}
+	}
+}
+
+// onOrderedSync moves the next height of g past the run synced
+func (b *Buffer) onOrderedSync(g *syncGroup) {
+	if g.syncing == nil || g.syncing.next < 0 {
+		return
+	}
+
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	if g.syncing.next > g.nextHeight {
+		g.nextHeight = g.syncing.next
+	}
+}
+
+// observeGap records the missing height holding back buffered ones, -1 if none. The time a gap persists
+// is measured from the first sync finding it
+func (g *syncGroup) observeGap(height int64) {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	if height != g.gapHeight || height < 0 {
+		g.gapHeight = height
+		g.gapSince = time.Now()
+		g.gapAlerted = false
+	}
+}
+
+// checkGap alerts once if the gap of g persisted longer than GapTimeout
+func (b *Buffer) checkGap(g *syncGroup) {
+	g.stateMutex.Lock()
+	height, since := g.gapHeight, g.gapSince
+	alert := height >= 0 && !g.gapAlerted && time.Since(since) >= b.config.GapTimeout
+	if alert {
+		g.gapAlerted = true
+	}
+	g.stateMutex.Unlock()
+
+	if height < 0 {
+		getMetrics().gapSeconds.WithLabelValues(b.name, g.label()).Set(0)
+		return
+	}
+	getMetrics().gapSeconds.WithLabelValues(b.name, g.label()).Set(time.Since(since).Seconds())
+
+	if !alert {
+		return
+	}
+
+	zap.S().Errorf("[Buffer] height %d is missing since %s, holding back the buffered heights of %s",
+		height, since.Format(time.RFC3339), g.name())
+	getMetrics().gapTimeouts.WithLabelValues(b.name, g.label()).Inc()
+
+	if b.gapAlertFn != nil {
+		b.gapAlertFn(g.label(), height, since)
+	}
+}
+
+// orderedRunSize returns the amount of heights of g ready to be synced in Ordered mode
+func (b *Buffer) orderedRunSize(g *syncGroup) uint {
+	b.keysMutex.RLock()
+	defer b.keysMutex.RUnlock()
+
+	run, stale, _ := b.orderedRun(g)
+	return uint(len(run) + len(stale))
+}
+
+// nextOf returns the height after the highest one of run, -1 if run is empty
+func nextOf(run map[int64]bool) int64 {
+	next := int64(-1)
+	for h := range run {
+		if h+1 > next {
+			next = h + 1
+		}
+	}
+
+	return next
+}
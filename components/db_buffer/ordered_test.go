@@ -0,0 +1,91 @@
+package db_buffer
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OrderedSync(t *testing.T) {
+	cfg := Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 100,
+		Ordered:            true,
+		GapTimeout:         time.Millisecond,
+		WalDir:             t.TempDir(),
+	}
+	buffer := NewDBBuffer(nil, cfg)
+	assert.NoError(t, buffer.RegisterKeyType("block", []int64{}))
+
+	synced := make(chan []int64, 1)
+	buffer.SetSyncFunc(func() SyncResult {
+		data, err := buffer.GetData("block")
+		assert.NoError(t, err)
+
+		var heights []int64
+		for k := range data {
+			h, _ := strconv.ParseInt(k, 10, 64)
+			heights = append(heights, h)
+		}
+		sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+		synced <- heights
+		return SyncResult{}
+	})
+
+	alerts := make(chan int64, 10)
+	buffer.SetGapAlertFunc(func(keys string, height int64, since time.Time) {
+		alerts <- height
+	})
+	assert.Error(t, buffer.Start())
+	buffer.SetNextHeight(1)
+	assert.NoError(t, buffer.Start())
+	defer buffer.Stop()
+
+	sync := func(heights ...int64) []int64 {
+		for _, h := range heights {
+			assert.NoError(t, buffer.InsertData("block", h, []int64{h}, false))
+		}
+		buffer.requestSync()
+		<-buffer.SyncComplete
+		return <-synced
+	}
+
+	// 4 is held until 3 arrives
+	assert.Equal(t, []int64{1, 2}, sync(1, 2, 4))
+	assert.Equal(t, int64(3), *buffer.GetStatus().Syncs[0].GapHeight)
+	assert.Equal(t, 1, buffer.GetBufferSize("block"))
+
+	// the held heights are kept in the WAL
+	replayBuffer := NewDBBuffer(nil, cfg)
+	assert.NoError(t, replayBuffer.RegisterKeyType("block", []int64{}))
+	heights, err := replayBuffer.ReplayWAL()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4}, heights)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, sync())
+	assert.Equal(t, int64(3), <-alerts)
+
+	// heights below the next one are synced out of order with the next sync
+	assert.NoError(t, buffer.InsertData("block", 0, []int64{0}, false))
+	assert.Equal(t, []int64{0, 3, 4, 5}, sync(3, 5))
+	assert.Nil(t, buffer.GetStatus().Syncs[0].GapHeight)
+	assert.Equal(t, 0, buffer.GetBufferSize("block"))
+
+	// and so are the heights left below the next one when it moves past a gap
+	assert.Empty(t, sync(8))
+	buffer.SetNextHeight(9)
+	assert.Equal(t, []int64{8}, sync())
+	assert.Nil(t, buffer.GetStatus().Syncs[0].GapHeight)
+	assert.Equal(t, 0, buffer.GetBufferSize("block"))
+}
+
+func Test_OrderedWithBudget(t *testing.T) {
+	// the heights held above a gap could fill the budget, and block the height filling it
+	buffer := NewDBBuffer(nil, Config{SyncTimePeriod: TestTimeout, Ordered: true, MaxItems: 10})
+	buffer.SetNextHeight(0)
+	assert.Error(t, buffer.Start())
+}
@@ -0,0 +1,135 @@
+package db_buffer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRetryBackoff    = 1 * time.Second
+	DefaultMaxRetryBackoff = 1 * time.Minute
+	DefaultMaxSyncRetries  = 10
+)
+
+// ErrHalted is returned by InsertData once a sync failure halted the buffer
+var ErrHalted = errors.New("[Buffer] buffer is halted")
+
+// SyncFailurePolicy defines what happens to the buffered data when a sync callback returns an error
+type SyncFailurePolicy int
+
+const (
+	// SyncFailureRetry keeps the data and retries the sync with an exponential backoff, up to MaxSyncRetries
+	// times in a row. Then RetriesExhaustedPolicy is applied
+	SyncFailureRetry SyncFailurePolicy = iota
+	// SyncFailureDrop clears the data and releases its in-progress heights, so they are fetched again
+	SyncFailureDrop
+	// SyncFailureHalt keeps the data and stops syncing. The error is sent on Buffer.Halted, and inserts fail
+	// with ErrHalted
+	SyncFailureHalt
+)
+
+// SyncStatus reports the sync state of the keys synced by a callback
+type SyncStatus struct {
+	Keys                string     `json:"keys"`
+	ConsecutiveFailures uint       `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	GapHeight           *int64     `json:"gap_height,omitempty"` // missing height holding back the buffered ones, in Ordered mode
+	GapSince            *time.Time `json:"gap_since,omitempty"`
+}
+
+// Status reports the sync state of the buffer
+type Status struct {
+	Halted    bool         `json:"halted"`
+	HaltError string       `json:"halt_error,omitempty"`
+	Syncs     []SyncStatus `json:"syncs"`
+}
+
+// GetStatus returns the sync state of the buffer and all its sync callbacks
+func (b *Buffer) GetStatus() Status {
+	status := Status{}
+	if err := b.haltError(); err != nil {
+		status.Halted = true
+		status.HaltError = err.Error()
+	}
+
+	for _, g := range b.getGroups() {
+		status.Syncs = append(status.Syncs, g.status())
+	}
+
+	return status
+}
+
+// onSyncFailure records the failure of a sync of g, and applies and returns the failure policy
+func (b *Buffer) onSyncFailure(g *syncGroup, err error) SyncFailurePolicy {
+	failures := g.recordFailure(err, b.retryBackoff)
+	b.updateFailuresMetric(g)
+
+	policy := b.config.FailurePolicy
+	if policy == SyncFailureRetry && b.config.MaxSyncRetries >= 0 && failures > uint(b.config.MaxSyncRetries) {
+		policy = b.config.RetriesExhaustedPolicy
+		zap.S().Errorf("[Buffer] sync of %s failed %d times in a row, giving up retrying", g.name(), failures)
+	}
+
+	switch policy {
+	case SyncFailureRetry:
+		zap.S().Errorf("[Buffer] sync of %s failed %d times in a row, retrying in %s: %v",
+			g.name(), failures, g.retryDelay(), err)
+	case SyncFailureHalt:
+		zap.S().Errorf("[Buffer] sync of %s failed, halting: %v", g.name(), err)
+		b.halt(fmt.Errorf("sync of %s failed %d times in a row: %w", g.name(), failures, err))
+	default:
+		zap.S().Errorf("[Buffer] sync of %s failed, dropping its data: %v", g.name(), err)
+	}
+
+	return policy
+}
+
+func (b *Buffer) onSyncSuccess(g *syncGroup) {
+	g.recordSuccess()
+	b.updateFailuresMetric(g)
+}
+
+// retryBackoff returns the time to wait before retrying after the given amount of consecutive failures
+func (b *Buffer) retryBackoff(failures uint) time.Duration {
+	backoff := b.config.RetryBackoff
+	for i := uint(1); i < failures && backoff < b.config.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > b.config.MaxRetryBackoff {
+		backoff = b.config.MaxRetryBackoff
+	}
+
+	return backoff
+}
+
+func (b *Buffer) halt(err error) {
+	b.haltMutex.Lock()
+	defer b.haltMutex.Unlock()
+
+	if b.haltErr != nil {
+		return
+	}
+
+	b.haltErr = err
+	getMetrics().halted.WithLabelValues(b.name).Set(1)
+	select {
+	case b.Halted <- err:
+	default:
+	}
+
+	// the inserts waiting for space would wait forever, as a halted buffer does not sync
+	b.budget.close()
+}
+
+func (b *Buffer) haltError() error {
+	b.haltMutex.Lock()
+	defer b.haltMutex.Unlock()
+
+	return b.haltErr
+}
@@ -0,0 +1,138 @@
+package db_buffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SyncFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy       SyncFailurePolicy
+		expectedSize int
+	}{
+		{SyncFailureRetry, 0},
+		{SyncFailureDrop, 0},
+		{SyncFailureHalt, 2},
+	}
+
+	for _, tt := range tests {
+		buffer := NewDBBuffer(nil, Config{
+			SyncTimePeriod:     TestTimeout,
+			SyncBlockThreshold: 2,
+			FailurePolicy:      tt.policy,
+			RetryBackoff:       100 * time.Millisecond,
+		})
+
+		var syncedSizes []int
+		buffer.SetSyncFunc(func() SyncResult {
+			syncedSizes = append(syncedSizes, buffer.GetBufferSize("transaction"))
+			if len(syncedSizes) == 1 {
+				return SyncResult{Error: fmt.Errorf("db is down")}
+			}
+			return SyncResult{}
+		})
+		buffer.Start()
+
+		for h := 0; h < 2; h++ {
+			assert.NoError(t, buffer.InsertData("transaction", int64(h), createMockTx(h), true))
+		}
+
+		result := <-buffer.SyncComplete
+		assert.Error(t, result.Error)
+		assert.Equal(t, uint(1), buffer.GetStatus().Syncs[0].ConsecutiveFailures)
+
+		switch tt.policy {
+		case SyncFailureRetry:
+			// the retry gets the data of the failed sync
+			result = <-buffer.SyncComplete
+			assert.NoError(t, result.Error)
+			assert.Equal(t, []int{2, 2}, syncedSizes)
+			assert.Equal(t, uint(0), buffer.GetStatus().Syncs[0].ConsecutiveFailures)
+		case SyncFailureHalt:
+			assert.Error(t, <-buffer.Halted)
+			assert.True(t, buffer.GetStatus().Halted)
+		}
+
+		assert.Equal(t, tt.expectedSize, buffer.GetBufferSize("transaction"))
+		buffer.Stop()
+	}
+}
+
+func Test_RetryBackoff(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:  TestSyncPeriod,
+		RetryBackoff:    time.Second,
+		MaxRetryBackoff: 5 * time.Second,
+	})
+
+	assert.Equal(t, time.Second, buffer.retryBackoff(1))
+	assert.Equal(t, 4*time.Second, buffer.retryBackoff(3))
+	assert.Equal(t, 5*time.Second, buffer.retryBackoff(10))
+}
+
+func Test_MaxSyncRetries(t *testing.T) {
+	for _, policy := range []SyncFailurePolicy{SyncFailureHalt, SyncFailureDrop} {
+		buffer := NewDBBuffer(nil, Config{
+			SyncTimePeriod:         TestTimeout,
+			SyncBlockThreshold:     2,
+			RetryBackoff:           10 * time.Millisecond,
+			MaxSyncRetries:         1,
+			RetriesExhaustedPolicy: policy,
+		})
+		buffer.SetSyncFunc(func() SyncResult {
+			return SyncResult{Error: fmt.Errorf("db is down")}
+		})
+		assert.NoError(t, buffer.Start())
+
+		for h := 0; h < 2; h++ {
+			assert.NoError(t, buffer.InsertData("transaction", int64(h), createMockTx(h), true))
+		}
+
+		// the first failure is retried, the second one applies the policy
+		assert.Error(t, (<-buffer.SyncComplete).Error)
+		assert.Error(t, (<-buffer.SyncComplete).Error)
+		assert.Equal(t, uint(2), buffer.GetStatus().Syncs[0].ConsecutiveFailures)
+
+		if policy == SyncFailureHalt {
+			assert.Error(t, <-buffer.Halted)
+			assert.True(t, buffer.GetStatus().Halted)
+			assert.Equal(t, 2, buffer.GetBufferSize("transaction"))
+			assert.ErrorIs(t, buffer.InsertData("transaction", 2, createMockTx(2), false), ErrHalted)
+		} else {
+			assert.False(t, buffer.GetStatus().Halted)
+			assert.Equal(t, 0, buffer.GetBufferSize("transaction"))
+		}
+		buffer.Stop()
+	}
+}
+
+func Test_DropReleasesHeights(t *testing.T) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 2,
+		FailurePolicy:      SyncFailureDrop,
+	})
+
+	requeued := make(chan []uint64, 1)
+	buffer.SetRequeueFunc(func(heights []uint64) {
+		requeued <- heights
+	})
+
+	// a failing callback does not report the heights it was given
+	buffer.SetSyncFunc(func() SyncResult {
+		return SyncResult{Error: fmt.Errorf("db is down")}
+	})
+	assert.NoError(t, buffer.Start())
+	defer buffer.Stop()
+
+	for h := 0; h < 2; h++ {
+		assert.NoError(t, buffer.InsertData("transaction", int64(h), createMockTx(h), true))
+	}
+
+	assert.Error(t, (<-buffer.SyncComplete).Error)
+	assert.Equal(t, []uint64{0, 1}, <-requeued)
+	assert.Equal(t, 0, buffer.GetBufferSize("transaction"))
+}
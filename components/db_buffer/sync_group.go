@@ -0,0 +1,163 @@
+package db_buffer
+
+import (
+	"sync"
+	"time"
+)
+
+// syncGroup holds the keys synced together by the same callback, with their own period and threshold
+type syncGroup struct {
+	key         string // empty for the default group, which syncs all the keys without their own callback
+	syncCb      SyncCB
+	txSyncCb    TxSyncCB    // used instead of syncCb if set
+	syncMutex   sync.Mutex  // held during a whole sync
+	insertMutex sync.Mutex  // held by inserts, and by syncs to swap generations
+	syncing     *generation // data being synced, guarded by the buffer keysMutex
+	syncTicker  *time.Ticker
+	period      time.Duration
+	threshold   uint
+	newDataChan chan string
+	syncReqChan chan bool
+	exitChan    chan bool
+
+	stateMutex  sync.Mutex // guards the sync state below, which is read while a sync is in progress
+	failures    uint
+	lastError   error
+	lastFailure time.Time
+	lastSuccess time.Time
+	retryAt     time.Time
+
+	// Ordered mode
+	nextHeight    int64 // lowest height not synced yet
+	hasNextHeight bool
+	gapHeight     int64 // missing height holding back buffered ones, -1 if none
+	gapSince      time.Time
+	gapAlerted    bool
+}
+
+func newSyncGroup(key string, cb SyncCB, period time.Duration, threshold uint) *syncGroup {
+	g := &syncGroup{
+		key:         key,
+		syncCb:      cb,
+		syncTicker:  time.NewTicker(period),
+		period:      period,
+		threshold:   threshold,
+		newDataChan: make(chan string, 1), // keeps a notification sent while a sync is in progress
+		syncReqChan: make(chan bool, 1),
+		exitChan:    make(chan bool, 1),
+		gapHeight:   -1,
+	}
+
+	g.syncTicker.Stop()
+	return g
+}
+
+func (g *syncGroup) setSyncFunc(cb SyncCB, txCb TxSyncCB) {
+	g.syncMutex.Lock()
+	defer g.syncMutex.Unlock()
+
+	g.syncCb, g.txSyncCb = cb, txCb
+}
+
+func (g *syncGroup) name() string {
+	if g.key == "" {
+		return "default keys"
+	}
+
+	return "key " + g.key
+}
+
+// label identifies g in the metrics
+func (g *syncGroup) label() string {
+	if g.key == "" {
+		return "default"
+	}
+
+	return g.key
+}
+
+// nextSyncDelay returns the time until the next ticker sync: the retry backoff after a failure, the period otherwise
+func (g *syncGroup) nextSyncDelay() time.Duration {
+	if delay := g.retryDelay(); delay > 0 {
+		return delay
+	}
+
+	return g.period
+}
+
+// retryDelay returns the time left before retrying a failed sync, 0 if not waiting for a retry
+func (g *syncGroup) retryDelay() time.Duration {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	if g.failures == 0 {
+		return 0
+	}
+
+	if delay := time.Until(g.retryAt); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// recordFailure stores a sync failure and schedules its retry. It returns the amount of consecutive failures
+func (g *syncGroup) recordFailure(err error, backoff func(failures uint) time.Duration) uint {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	g.failures++
+	g.lastError = err
+	g.lastFailure = time.Now()
+	g.retryAt = g.lastFailure.Add(backoff(g.failures))
+
+	return g.failures
+}
+
+func (g *syncGroup) recordSuccess() {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	g.failures = 0
+	g.lastSuccess = time.Now()
+}
+
+func (g *syncGroup) status() SyncStatus {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+
+	status := SyncStatus{
+		Keys:                g.name(),
+		ConsecutiveFailures: g.failures,
+	}
+
+	if !g.lastFailure.IsZero() {
+		lastFailure := g.lastFailure
+		status.LastFailure = &lastFailure
+		status.LastError = g.lastError.Error()
+	}
+
+	if !g.lastSuccess.IsZero() {
+		lastSuccess := g.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+
+	if g.gapHeight >= 0 {
+		gapHeight, gapSince := g.gapHeight, g.gapSince
+		status.GapHeight = &gapHeight
+		status.GapSince = &gapSince
+	}
+
+	return status
+}
+
+// stop stops the group's sync loop, waiting for a sync in progress to finish
+func (g *syncGroup) stop() {
+	g.syncTicker.Stop()
+	// closes the loop in func checkIsTimeToSync
+	g.exitChan <- true
+
+	// wait if a syncing event is in progress,
+	// syncMutex gets released in func callSync
+	g.syncMutex.Lock()
+	defer g.syncMutex.Unlock()
+}
@@ -0,0 +1,67 @@
+package db_buffer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Zondax/zindexer/components/tracker"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// TxSyncCB writes the buffered data using tx. The heights it reports are tracked in the same transaction,
+// so data and tracker state are committed, or rolled back, together
+type TxSyncCB func(tx *gorm.DB) SyncResult
+
+// SetTxSyncFunc sets a transactional syncing callback function for all the keys without their own callback
+func (b *Buffer) SetTxSyncFunc(cb TxSyncCB) {
+	b.defaultGroup.setSyncFunc(nil, cb)
+}
+
+// SetKeyTxSyncFunc sets a transactional syncing callback function for the data under key. See SetKeySyncFunc
+func (b *Buffer) SetKeyTxSyncFunc(key string, cb TxSyncCB, cfg KeyConfig) {
+	b.setKeyGroup(key, nil, cb, cfg)
+}
+
+// runSync calls the sync callback of g and tracks the heights it synced
+func (b *Buffer) runSync(g *syncGroup) SyncResult {
+	if g.txSyncCb == nil {
+		result := g.syncCb()
+		if result.Error != nil {
+			return result
+		}
+
+		// Without a shared transaction, an idempotent sink can be called again if its heights could not be tracked
+		err := b.onDBSyncComplete(g, &result, b.dbConn)
+		if err != nil && b.config.IdempotentSync {
+			result.Error = fmt.Errorf("could not track synced heights: %w", err)
+		}
+		return result
+	}
+
+	if b.dbConn == nil {
+		return SyncResult{Error: fmt.Errorf("transactional sync requires a database connection")}
+	}
+
+	// The tracker holds back its metric and progress updates until the transaction commits
+	ctx := tracker.DeferUpdates(context.Background())
+
+	var result SyncResult
+	err := b.dbConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result = g.txSyncCb(tx)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return b.onDBSyncComplete(g, &result, tx)
+	})
+	if err != nil && result.Error == nil {
+		zap.S().Errorf("[Buffer] sync transaction of %s failed: %v", g.name(), err)
+		result.Error = err
+	}
+	if err == nil {
+		tracker.PublishUpdates(ctx)
+	}
+
+	return result
+}
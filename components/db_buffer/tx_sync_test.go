@@ -0,0 +1,67 @@
+package db_buffer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// unreachableDB returns a connection whose statements fail, as with a database that is down
+func unreachableDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1 connect_timeout=1"}),
+		&gorm.Config{DisableAutomaticPing: true, Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func Test_SyncTrackingFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		idempotent bool
+		tx         bool
+		wantError  bool
+	}{
+		{"legacy sync ignores tracker errors", false, false, false},
+		{"idempotent sync fails on tracker errors", true, false, true},
+		{"transactional sync fails on tracker errors", false, true, true},
+	}
+
+	for _, tt := range tests {
+		buffer := NewDBBuffer(unreachableDB(t), Config{
+			SyncTimePeriod:     TestTimeout,
+			SyncBlockThreshold: 1,
+			FailurePolicy:      SyncFailureHalt,
+			IdempotentSync:     tt.idempotent,
+		})
+
+		heights := []uint64{0}
+		if tt.tx {
+			buffer.SetTxSyncFunc(func(tx *gorm.DB) SyncResult {
+				return SyncResult{Id: "test", SyncedHeights: &heights}
+			})
+		} else {
+			buffer.SetSyncFunc(func() SyncResult {
+				return SyncResult{Id: "test", SyncedHeights: &heights}
+			})
+		}
+		buffer.Start()
+
+		assert.NoError(t, buffer.InsertData("transaction", 0, createMockTx(0), true))
+		result := <-buffer.SyncComplete
+
+		assert.Equal(t, tt.wantError, result.Error != nil, fmt.Sprintf("%s: %v", tt.name, result.Error))
+		if tt.wantError {
+			// the data is kept to be synced again
+			assert.Equal(t, 1, buffer.GetBufferSize("transaction"), tt.name)
+		}
+
+		buffer.Stop()
+	}
+}
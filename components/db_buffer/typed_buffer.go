@@ -0,0 +1,107 @@
+package db_buffer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// TypedBuffer gives compile-time checked access to the data buffered under a key of a Buffer.
+// Each height holds a slice of T
+type TypedBuffer[T any] struct {
+	buffer *Buffer
+	key    string
+}
+
+// HeightData holds the items buffered for a height
+type HeightData[T any] struct {
+	Height int64
+	Items  []T
+}
+
+// RegisterTypedBuffer returns a TypedBuffer storing []T under key. It fails if key was already registered with another type
+func RegisterTypedBuffer[T any](b *Buffer, key string) (*TypedBuffer[T], error) {
+	if err := b.registerKeyType(key, reflect.TypeOf([]T{})); err != nil {
+		return nil, err
+	}
+
+	return &TypedBuffer[T]{buffer: b, key: key}, nil
+}
+
+// Key returns the buffer key the data is stored under
+func (t *TypedBuffer[T]) Key() string {
+	return t.key
+}
+
+// InsertData appends items to the ones buffered for height. See Buffer.InsertData
+func (t *TypedBuffer[T]) InsertData(height int64, items []T, notify bool) error {
+	return t.buffer.InsertData(t.key, height, items, notify)
+}
+
+// ReplaceHeight overwrites the items buffered for height. See Buffer.ReplaceHeight
+func (t *TypedBuffer[T]) ReplaceHeight(height int64, items []T, notify bool) error {
+	return t.buffer.ReplaceHeight(t.key, height, items, notify)
+}
+
+// GetData returns the buffered items by height
+func (t *TypedBuffer[T]) GetData() (map[int64][]T, error) {
+	result := make(map[int64][]T)
+
+	m, ok := t.buffer.getMap(t.key)
+	if !ok {
+		return result, nil
+	}
+
+	for k, v := range m.Items() {
+		height, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("[Buffer] invalid height '%s' for key %s: %w", k, t.key, err)
+		}
+
+		items, ok := v.([]T)
+		if !ok {
+			return nil, fmt.Errorf("[Buffer] unexpected type %T for key %s, height %d", v, t.key, height)
+		}
+
+		result[height] = items
+	}
+
+	return result, nil
+}
+
+// GetSortedData returns the buffered items grouped by height, in ascending height order
+func (t *TypedBuffer[T]) GetSortedData() ([]HeightData[T], error) {
+	data, err := t.GetData()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]HeightData[T], 0, len(data))
+	for height, items := range data {
+		result = append(result, HeightData[T]{Height: height, Items: items})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Height < result[j].Height
+	})
+
+	return result, nil
+}
+
+// GetItems returns all the buffered items, in ascending height order, and the heights they belong to
+func (t *TypedBuffer[T]) GetItems() ([]T, []uint64, error) {
+	sorted, err := t.GetSortedData()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var items []T
+	heights := make([]uint64, 0, len(sorted))
+	for _, d := range sorted {
+		items = append(items, d.Items...)
+		heights = append(heights, uint64(d.Height))
+	}
+
+	return items, heights, nil
+}
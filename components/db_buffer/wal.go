@@ -0,0 +1,375 @@
+package db_buffer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	walExtension = ".wal"
+	// segmentExtension is appended to the log of a key while its data is being synced
+	segmentExtension = ".syncing"
+)
+
+type walRecord struct {
+	Height  int64           `json:"height"`
+	Data    json.RawMessage `json:"data"`
+	Replace bool            `json:"replace,omitempty"`
+}
+
+// wal is a write-ahead log of the buffered data, with one file per key. It mirrors the buffer contents:
+// inserts are appended to it and it is truncated when the key is cleared. When a sync starts, the file is
+// rotated to a segment, which is removed once the sync succeeds
+type wal struct {
+	dir   string
+	fsync bool
+	mutex sync.Mutex
+	files map[string]*os.File
+}
+
+// ReplayWAL loads the data logged in the write-ahead log back into the buffer, and returns its heights.
+// It must be called before Start, once the types of all the keys are registered. The budget is not enforced,
+// so all the logged data is recovered
+func (b *Buffer) ReplayWAL() ([]uint64, error) {
+	if b.wal == nil {
+		return nil, fmt.Errorf("[Buffer] WAL is not enabled. Set WalDir")
+	}
+
+	replayed := make(map[uint64]bool)
+	err := b.wal.replay(func(key string, record walRecord) error {
+		height := record.Height
+		b.keysMutex.RLock()
+		t, ok := b.keyTypes[key]
+		b.keysMutex.RUnlock()
+		if !ok {
+			return fmt.Errorf("[Buffer] key %s has no registered type, cannot replay its WAL", key)
+		}
+
+		value := reflect.New(t)
+		if err := json.Unmarshal(record.Data, value.Interface()); err != nil {
+			return fmt.Errorf("[Buffer] could not decode WAL record of key %s, height %d: %w", key, height, err)
+		}
+		data := value.Elem().Interface()
+
+		m, err := b.getOrCreateMap(key, data)
+		if err != nil {
+			return err
+		}
+
+		heightKey := strconv.FormatInt(height, 10)
+		old, exists := m.Get(heightKey)
+		merged, err := mergeHeightData(old, exists, data, record.Replace)
+		if errors.Is(err, ErrHeightExists) {
+			// only accepted inserts are logged, so the height was inserted again while its value was being
+			// synced, and replaces it as in restoreGeneration
+			merged, err = data, nil
+		}
+		if err != nil {
+			return fmt.Errorf("[Buffer] could not replay WAL record of key %s, height %d: %w", key, height, err)
+		}
+
+		size := estimateSize(data)
+		b.budget.forceReserve(size)
+		m.Set(heightKey, merged)
+		b.accountInsert(key, size, old, exists, merged)
+
+		b.updateItemsMetric(key)
+		replayed[uint64(height)] = true
+		return nil
+	})
+	if err != nil {
+		zap.S().Errorf("[Buffer] WAL replay failed: %v", err)
+		return nil, err
+	}
+
+	heights := make([]uint64, 0, len(replayed))
+	for h := range replayed {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	b.updateFullnessMetric()
+	zap.S().Infof("[Buffer] replayed %d heights from the WAL", len(heights))
+	return heights, nil
+}
+
+func newWal(dir string, fsync bool) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("[Buffer] could not create WAL directory %s: %w", dir, err)
+	}
+
+	return &wal{
+		dir:   dir,
+		fsync: fsync,
+		files: make(map[string]*os.File),
+	}, nil
+}
+
+func (w *wal) path(key string) string {
+	return filepath.Join(w.dir, url.PathEscape(key)+walExtension)
+}
+
+func (w *wal) segmentPath(key string) string {
+	return w.path(key) + segmentExtension
+}
+
+func (w *wal) getFile(key string) (*os.File, error) {
+	if f, ok := w.files[key]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(w.path(key), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	w.files[key] = f
+	return f, nil
+}
+
+// append logs the insertion of data for height under key, which replaces the height data if replace is set
+func (w *wal) append(key string, height int64, data interface{}, replace bool) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("[Buffer] could not encode WAL record for key %s: %w", key, err)
+	}
+
+	line, err := json.Marshal(walRecord{Height: height, Data: raw, Replace: replace})
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	f, err := w.getFile(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("[Buffer] could not write WAL of key %s: %w", key, err)
+	}
+
+	if w.fsync {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+// truncate removes all the records logged under key
+func (w *wal) truncate(key string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	f, err := w.getFile(key)
+	if err != nil {
+		return err
+	}
+
+	return f.Truncate(0)
+}
+
+// rotate moves the records logged under key to its segment, so new inserts are logged apart
+func (w *wal) rotate(key string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closeFile(key)
+
+	// a segment left by a previous run keeps its records, the log is added after them
+	merged, err := w.appendLogToSegment(key)
+	if err != nil || merged {
+		return err
+	}
+
+	err = os.Rename(w.path(key), w.segmentPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// restore moves the records of the segment of key back to its log, before the ones logged since rotate
+func (w *wal) restore(key string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closeFile(key)
+	return w.restoreSegment(key)
+}
+
+// restoreSegment is restore for callers holding mutex
+func (w *wal) restoreSegment(key string) error {
+	merged, err := w.appendLogToSegment(key)
+	if err != nil || !merged {
+		return err
+	}
+
+	return os.Rename(w.segmentPath(key), w.path(key))
+}
+
+// appendLogToSegment appends the log of key to its segment, and removes the log. It does nothing and returns
+// false if key has no segment. The file of key must be closed
+func (w *wal) appendLogToSegment(key string) (bool, error) {
+	newer, err := os.ReadFile(w.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	segment, err := os.OpenFile(w.segmentPath(key), os.O_APPEND|os.O_WRONLY, 0o640)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = segment.Write(newer); err != nil {
+		segment.Close()
+		return false, err
+	}
+	if w.fsync {
+		if err = segment.Sync(); err != nil {
+			segment.Close()
+			return false, err
+		}
+	}
+	if err = segment.Close(); err != nil {
+		return false, err
+	}
+
+	err = os.Remove(w.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// removeSegment removes the records of key which were synced
+func (w *wal) removeSegment(key string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := os.Remove(w.segmentPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// replay calls fn for every record logged, in insertion order for each key
+func (w *wal) replay(fn func(key string, record walRecord) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	logs, err := filepath.Glob(filepath.Join(w.dir, "*"+walExtension))
+	if err != nil {
+		return err
+	}
+
+	segments, err := filepath.Glob(filepath.Join(w.dir, "*"+walExtension+segmentExtension))
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for _, path := range append(logs, segments...) {
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), segmentExtension), walExtension)
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			return fmt.Errorf("[Buffer] invalid WAL file name %s: %w", path, err)
+		}
+		keys[key] = true
+	}
+
+	for key := range keys {
+		// the segment of a sync interrupted by the crash holds the oldest records
+		for _, path := range []string{w.segmentPath(key), w.path(key)} {
+			if err = replayFile(path, key, fn); err != nil {
+				return err
+			}
+		}
+
+		// its records are buffered again, so they go back to the log, which the next sync rotates
+		w.closeFile(key)
+		if err = w.restoreSegment(key); err != nil {
+			return fmt.Errorf("[Buffer] could not merge the WAL segment of key %s back into its log: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func replayFile(path string, key string, fn func(key string, record walRecord) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// the last record was being written when the process stopped, its insert never completed
+				zap.S().Warnf("[Buffer] ignoring incomplete WAL record of key %s", key)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var record walRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("[Buffer] invalid WAL record of key %s: %w", key, err)
+		}
+
+		if err = fn(key, record); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *wal) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for key := range w.files {
+		w.closeFile(key)
+	}
+}
+
+func (w *wal) closeFile(key string) {
+	f, ok := w.files[key]
+	if !ok {
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		zap.S().Errorf("[Buffer] could not close WAL of key %s: %v", key, err)
+	}
+	delete(w.files, key)
+}
@@ -0,0 +1,130 @@
+package db_buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newWalBuffer(t *testing.T, dir string) (*Buffer, *TypedBuffer[ReportTransaction]) {
+	buffer := NewDBBuffer(nil, Config{
+		SyncTimePeriod:     TestTimeout,
+		SyncBlockThreshold: 100,
+		WalDir:             dir,
+	})
+
+	txsBuffer, err := RegisterTypedBuffer[ReportTransaction](buffer, "transaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer, txsBuffer
+}
+
+func Test_WalReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	buffer, txsBuffer := newWalBuffer(t, dir)
+	buffer.Start()
+
+	var allTxs []ReportTransaction
+	for h := 0; h < 3; h++ {
+		txs := []ReportTransaction{createMockTx(h), createMockTx(h)}
+		allTxs = append(allTxs, txs...)
+		assert.NoError(t, txsBuffer.InsertData(int64(h), txs, false))
+	}
+
+	// Appends and replacements are replayed in order
+	appended := createMockTx(0)
+	assert.NoError(t, txsBuffer.InsertData(0, []ReportTransaction{appended}, false))
+	replaced := createMockTx(2)
+	assert.NoError(t, txsBuffer.ReplaceHeight(2, []ReportTransaction{replaced}, false))
+	allTxs = append(allTxs[:2], append([]ReportTransaction{appended}, allTxs[2:4]...)...)
+	allTxs = append(allTxs, replaced)
+
+	// Keys without a registered type cannot be logged
+	assert.Error(t, buffer.InsertData("untyped", 0, 1, false))
+
+	// Stopping without syncing loses the data in memory only
+	buffer.Stop()
+
+	replayBuffer, replayTxsBuffer := newWalBuffer(t, dir)
+	heights, err := replayBuffer.ReplayWAL()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 1, 2}, heights)
+
+	items, _, err := replayTxsBuffer.GetItems()
+	assert.NoError(t, err)
+	assert.Equal(t, allTxs, items)
+
+	// Clearing the buffer, as a sync does, truncates the log
+	replayBuffer.ClearBuffer("transaction")
+
+	emptyBuffer, _ := newWalBuffer(t, dir)
+	heights, err = emptyBuffer.ReplayWAL()
+	assert.NoError(t, err)
+	assert.Empty(t, heights)
+}
+
+func Test_WalReplaySegment(t *testing.T) {
+	dir := t.TempDir()
+
+	buffer, txsBuffer := newWalBuffer(t, dir)
+	buffer.Start()
+
+	txs := []ReportTransaction{createMockTx(0), createMockTx(1)}
+	assert.NoError(t, txsBuffer.InsertData(0, txs[:1], false))
+
+	// the process stops while the data of height 0 is being synced
+	assert.NoError(t, buffer.wal.rotate("transaction"))
+	assert.NoError(t, txsBuffer.InsertData(1, txs[1:], false))
+	buffer.Stop()
+
+	// the replayed segment goes back to the log, so the next sync does not lose it from disk
+	replayBuffer, _ := newWalBuffer(t, dir)
+	heights, err := replayBuffer.ReplayWAL()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 1}, heights)
+	assert.NoFileExists(t, replayBuffer.wal.segmentPath("transaction"))
+
+	assert.NoError(t, replayBuffer.wal.rotate("transaction"))
+	replayBuffer.wal.close()
+
+	crashBuffer, crashTxsBuffer := newWalBuffer(t, dir)
+	heights, err = crashBuffer.ReplayWAL()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 1}, heights)
+
+	items, _, err := crashTxsBuffer.GetItems()
+	assert.NoError(t, err)
+	assert.Equal(t, txs, items)
+}
+
+func Test_WalReplayValueInsertedDuringSync(t *testing.T) {
+	dir := t.TempDir()
+	newSummaryBuffer := func() *Buffer {
+		buffer, _ := newWalBuffer(t, dir)
+		assert.NoError(t, buffer.RegisterKeyType("summary", ReportTransaction{}))
+		return buffer
+	}
+
+	// the process stops while height 0 is being synced, after it was inserted again
+	buffer := newSummaryBuffer()
+	assert.NoError(t, buffer.wal.append("summary", 0, createMockTx(0), false))
+	assert.NoError(t, buffer.wal.rotate("summary"))
+	assert.NoError(t, buffer.wal.append("summary", 0, createMockTx(1), false))
+	buffer.wal.close()
+
+	// the value inserted again replaces the one being synced, also once the segment is back in the log
+	for i := 0; i < 2; i++ {
+		replayBuffer := newSummaryBuffer()
+		heights, err := replayBuffer.ReplayWAL()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{0}, heights)
+
+		data, err := replayBuffer.GetData("summary")
+		assert.NoError(t, err)
+		assert.Equal(t, createMockTx(1), data["0"])
+		replayBuffer.wal.close()
+	}
+}
@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Data type sub-trackers track the heights written for each data type (e.g. blocks, transactions, events) of an
+// indexer. They share the in-progress heights of the indexer id they belong to, so a data type can be reindexed
+// without affecting the others.
+
+func UpdateTrackedHeightsForType(heights *[]uint64, id string, dataType string, db *gorm.DB) error {
+	return UpdateTrackedSectionsForType(BuildSectionsFromSlice(heights), id, dataType, db)
+}
+
+// UpdateTrackedSectionsForType merges the given sections into the ones already tracked for (id, dataType)
+func UpdateTrackedSectionsForType(sections Sections, id string, dataType string, db *gorm.DB) error {
+	if err := checkDataType(dataType); err != nil {
+		return err
+	}
+
+	return updateTrackedSections(sections, id, dataType, db)
+}
+
+// RemoveSectionsForType removes the given sections from the ones tracked for (id, dataType)
+func RemoveSectionsForType(toRemove Sections, id string, dataType string, db *gorm.DB) error {
+	if err := checkDataType(dataType); err != nil {
+		return err
+	}
+
+	return removeSectionsFromTracker(toRemove, id, dataType, db)
+}
+
+// GetSectionsForType returns the merged sections currently tracked for (id, dataType)
+func GetSectionsForType(id string, dataType string, db *gorm.DB) (Sections, error) {
+	if err := checkDataType(dataType); err != nil {
+		return nil, err
+	}
+
+	return getSections(id, dataType, db)
+}
+
+// GetDataTypes returns the data types with a sub-tracker for id
+func GetDataTypes(id string, db *gorm.DB) ([]string, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	return readDataTypes(id, db)
+}
+
+// GetMissingHeightsForType returns the heights between genesisHeight and chainTip which are neither tracked
+// for (id, dataType) nor in progress for id
+func GetMissingHeightsForType(chainTip uint64, genesisHeight uint64, limit uint64, id string, dataType string, db *gorm.DB) (*[]uint64, error) {
+	return GetMissingHeightsForTypes(chainTip, genesisHeight, limit, id, []string{dataType}, db)
+}
+
+// GetMissingHeightsForTypes returns the heights between genesisHeight and chainTip which are not tracked for
+// every one of dataTypes, i.e. the gaps in the intersection of their sub-trackers, and not in progress for id.
+// Heights tracked with an outdated version by any of the data types are returned last, as in GetMissingHeights
+func GetMissingHeightsForTypes(chainTip uint64, genesisHeight uint64, limit uint64, id string, dataTypes []string, db *gorm.DB) (*[]uint64, error) {
+	if len(dataTypes) == 0 {
+		return nil, fmt.Errorf("at least one data type is required")
+	}
+
+	for _, dataType := range dataTypes {
+		if err := checkDataType(dataType); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := GetVersionConfig(id)
+
+	var missing *[]uint64
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		var tracked, upToDate Sections
+		for i, dataType := range dataTypes {
+			versioned, err := readVersionedDb(id, dataType, sqlTx)
+			if err != nil {
+				zap.S().Errorf("[GetMissingHeightsForTypes] - %v", err)
+				return err
+			}
+
+			typeTracked, typeUpToDate := splitByVersion(versioned, cfg.Version)
+			if i == 0 {
+				tracked, upToDate = typeTracked, typeUpToDate
+				continue
+			}
+			tracked = IntersectSections(tracked, typeTracked)
+			upToDate = IntersectSections(upToDate, typeUpToDate)
+		}
+
+		outdated := RemoveSections(tracked, upToDate)
+
+		var err error
+		missing, err = findMissingHeights(tracked, outdated, chainTip, genesisHeight, limit, cfg.ReindexPolicy, id, sqlTx)
+		return err
+	}, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+func readDataTypes(id string, db *gorm.DB) ([]string, error) {
+	var dataTypes []string
+	tx := db.Model(&DbSection{}).Where("indexer_id = ? AND data_type <> ?", id, "").
+		Distinct().Order("data_type").Pluck("data_type", &dataTypes)
+
+	return dataTypes, tx.Error
+}
+
+func checkDataType(dataType string) error {
+	if dataType == "" {
+		return fmt.Errorf("data type cannot be empty")
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package tracker
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// RenameTracker moves all the sections, data types and in-progress leases of id 'from' to id 'to', keeping their
+// versions. It fails if 'from' has nothing tracked nor in progress, or if 'to' has
+func RenameTracker(from string, to string, db *gorm.DB) error {
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		if err := checkTracked(from, sqlTx); err != nil {
+			return err
+		}
+		if err := checkUntracked(to, sqlTx); err != nil {
+			return err
+		}
+
+		src, err := readAllVersioned(from, sqlTx)
+		if err != nil {
+			return err
+		}
+
+		for dataType, versioned := range src {
+			dst, err := readVersionedDb(to, dataType, sqlTx)
+			if err != nil {
+				return err
+			}
+
+			mergeVersions(dst, versioned)
+			if err = writeVersionedSections(to, dataType, dst, sqlTx); err != nil {
+				return err
+			}
+			if err = deleteSections(from, dataType, sqlTx); err != nil {
+				return err
+			}
+		}
+
+		return sqlTx.Model(&WipLease{}).Where("indexer_id = ?", from).Update("indexer_id", to).Error
+	}, from, to)
+	if err != nil {
+		zap.S().Errorf("[RenameTracker] - %v", err)
+		return err
+	}
+
+	// 'from' does not exist anymore, so it stops exporting metrics
+	forgetIdMetrics(from)
+	return refreshIdMetrics(db, to)
+}
+
+// CopyTracker copies all the sections and data types of id 'from' to id 'to', keeping their versions.
+// It fails if 'from' has nothing tracked nor in progress, or if 'to' has
+func CopyTracker(from string, to string, db *gorm.DB) error {
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		if err := checkTracked(from, sqlTx); err != nil {
+			return err
+		}
+		if err := checkUntracked(to, sqlTx); err != nil {
+			return err
+		}
+
+		src, err := readAllVersioned(from, sqlTx)
+		if err != nil {
+			return err
+		}
+
+		for dataType, versioned := range src {
+			if err = writeVersionedSections(to, dataType, versioned, sqlTx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, from, to)
+	if err != nil {
+		zap.S().Errorf("[CopyTracker] - %v", err)
+		return err
+	}
+
+	return refreshIdMetrics(db, to)
+}
+
+// MergeTrackers adds the sections and data types of id 'from' to the ones of id 'into'. Heights already
+// tracked in 'into' keep their version. 'from' is left untouched. It fails if 'from' has nothing tracked nor
+// in progress
+func MergeTrackers(from string, into string, db *gorm.DB) error {
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		if err := checkTracked(from, sqlTx); err != nil {
+			return err
+		}
+
+		src, err := readAllVersioned(from, sqlTx)
+		if err != nil {
+			return err
+		}
+
+		for dataType, versioned := range src {
+			dst, err := readVersionedDb(into, dataType, sqlTx)
+			if err != nil {
+				return err
+			}
+
+			mergeVersions(dst, versioned)
+			if err = writeVersionedSections(into, dataType, dst, sqlTx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, from, into)
+	if err != nil {
+		zap.S().Errorf("[MergeTrackers] - %v", err)
+		return err
+	}
+
+	return refreshIdMetrics(db, into)
+}
+
+// DiffTrackers returns the sections tracked for id 'a' but not for 'b', and the ones tracked for 'b' but not for 'a'
+func DiffTrackers(a string, b string, db *gorm.DB) (onlyA Sections, onlyB Sections, err error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	var sectionsA, sectionsB SectionId
+	err = db.Transaction(func(sqlTx *gorm.DB) error {
+		if sectionsA, err = readDb(a, "", sqlTx); err != nil {
+			return err
+		}
+
+		sectionsB, err = readDb(b, "", sqlTx)
+		return err
+	})
+	if err != nil {
+		zap.S().Errorf("[DiffTrackers] - %v", err)
+		return nil, nil, err
+	}
+
+	trackedA := MergeSections(sectionsA.Sections)
+	trackedB := MergeSections(sectionsB.Sections)
+
+	return RemoveSections(trackedA, trackedB), RemoveSections(trackedB, trackedA), nil
+}
+
+// mergeVersions adds the heights of src not tracked in dst, keeping the version they have in src
+func mergeVersions(dst VersionedSections, src VersionedSections) {
+	tracked, _ := splitByVersion(dst, 0)
+
+	for version, sections := range src {
+		added := RemoveSections(MergeSections(sections), tracked)
+		if len(added) == 0 {
+			continue
+		}
+
+		dst[version] = MergeSections(append(dst[version], added...))
+	}
+}
+
+// readAllVersioned returns the versioned sections of id for the indexer tracker and all its data types
+func readAllVersioned(id string, db *gorm.DB) (map[string]VersionedSections, error) {
+	dataTypes, err := readDataTypes(id, db)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]VersionedSections, len(dataTypes)+1)
+	for _, dataType := range append([]string{""}, dataTypes...) {
+		versioned, err := readVersionedDb(id, dataType, db)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(versioned) > 0 {
+			all[dataType] = versioned
+		}
+	}
+
+	return all, nil
+}
+
+// checkTracked fails if id has no sections nor in-progress heights
+func checkTracked(id string, db *gorm.DB) error {
+	count, err := countRows(id, db)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return fmt.Errorf("tracker id '%s' has nothing tracked nor in progress", id)
+	}
+
+	return nil
+}
+
+// checkUntracked fails if id has sections or in-progress heights
+func checkUntracked(id string, db *gorm.DB) error {
+	count, err := countRows(id, db)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("tracker id '%s' is already tracked or has heights in progress", id)
+	}
+
+	return nil
+}
+
+// forgetIdMetrics removes the tracker and progress metrics of id, and its progress state
+func forgetIdMetrics(id string) {
+	m := getMetrics()
+	m.trackedHeights.DeleteLabelValues(id)
+	m.wipHeights.DeleteLabelValues(id)
+	m.sections.DeleteLabelValues(id)
+	m.trackedTip.DeleteLabelValues(id)
+	m.missingHeights.DeleteLabelValues(id)
+
+	forgetProgress(id)
+}
+
+// countRows returns the amount of sections and in-progress leases of id
+func countRows(id string, db *gorm.DB) (int64, error) {
+	var sections, leases int64
+	if err := db.Model(&DbSection{}).Where("indexer_id = ?", id).Count(&sections).Error; err != nil {
+		return 0, err
+	}
+	if err := db.Model(&WipLease{}).Where("indexer_id = ?", id).Count(&leases).Error; err != nil {
+		return 0, err
+	}
+
+	return sections + leases, nil
+}
+
+// refreshIdMetrics updates the sections, progress and in-progress metrics of ids from their stored state
+func refreshIdMetrics(db *gorm.DB, ids ...string) error {
+	for _, id := range ids {
+		versioned, err := readVersionedDb(id, "", db)
+		if err != nil {
+			return err
+		}
+
+		merged, outdated := splitOutdated(versioned, id)
+		publish(db, func() {
+			setSectionsMetrics(id, merged)
+			recordProgress(id, merged, outdated, 0)
+		})
+		if err = refreshInProgressMetrics(id, db); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
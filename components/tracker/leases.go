@@ -0,0 +1,226 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Zondax/zindexer/components/connections/database/postgres"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// WipLease marks a section of heights as in-progress for an indexer. It is owned by the instance which
+// dispatched the heights, and is reclaimed once it expires so crashed instances do not block them forever
+type WipLease struct {
+	Section
+	ID        uint64 `gorm:"primaryKey"`
+	IndexerId string `gorm:"index"`
+	Owner     string
+	ExpiresAt *time.Time // nil if the lease never expires
+}
+
+type WipLeases = []WipLease
+
+func (WipLease) TableName() string {
+	return postgres.GetTableName("tracking_wip")
+}
+
+// LeaseConfig defines the owner and duration of the in-progress leases taken for an indexer
+type LeaseConfig struct {
+	Owner string
+	TTL   time.Duration // Leases never expire if TTL is 0
+}
+
+var (
+	leaseMutex   sync.RWMutex
+	leaseConfigs = make(map[string]LeaseConfig)
+)
+
+// SetLeaseConfig sets the owner and duration of the in-progress leases taken for id from now on
+func SetLeaseConfig(id string, cfg LeaseConfig) {
+	leaseMutex.Lock()
+	defer leaseMutex.Unlock()
+
+	leaseConfigs[id] = cfg
+}
+
+// GetLeaseConfig returns the lease config of id. Leases have no owner and never expire if none was set
+func GetLeaseConfig(id string) LeaseConfig {
+	leaseMutex.RLock()
+	defer leaseMutex.RUnlock()
+
+	return leaseConfigs[id]
+}
+
+// ClearOwnedInProgress removes the in-progress leases of id owned by owner
+func ClearOwnedInProgress(id string, owner string, db *gorm.DB) error {
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		tx := sqlTx.Delete(&WipLeases{}, "indexer_id = ? AND owner = ?", id, owner)
+		if tx.Error != nil {
+			zap.S().Errorf("[ClearOwnedInProgress]- %v", tx.Error.Error())
+			return tx.Error
+		}
+
+		return clearLegacyInProgress(id, sqlTx)
+	}, id)
+}
+
+// RenewLeases extends the expiry of the in-progress leases of id owned by owner
+func RenewLeases(id string, owner string, ttl time.Duration, db *gorm.DB) error {
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		tx := sqlTx.Model(&WipLease{}).Where("indexer_id = ? AND owner = ?", id, owner).Update("expires_at", leaseExpiry(ttl))
+		if tx.Error != nil {
+			zap.S().Errorf("[RenewLeases]- %v", tx.Error.Error())
+			return tx.Error
+		}
+
+		return nil
+	}, id)
+}
+
+// ReclaimExpiredLeases removes the expired in-progress leases of id, so their heights can be dispatched again.
+// It returns the amount of leases reclaimed
+func ReclaimExpiredLeases(id string, db *gorm.DB) (int64, error) {
+	var reclaimed int64
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		tx := sqlTx.Delete(&WipLeases{}, "indexer_id = ? AND expires_at IS NOT NULL AND expires_at < ?", id, time.Now())
+		if tx.Error != nil {
+			zap.S().Errorf("[ReclaimExpiredLeases]- %v", tx.Error.Error())
+			return tx.Error
+		}
+
+		reclaimed = tx.RowsAffected
+		if reclaimed == 0 {
+			return nil
+		}
+
+		zap.S().Infof("[ReclaimExpiredLeases] - reclaimed %d expired leases of '%s'", reclaimed, id)
+		return refreshInProgressMetrics(id, sqlTx)
+	}, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return reclaimed, nil
+}
+
+// GetLeases returns the in-progress leases of id, including expired ones not reclaimed yet
+func GetLeases(id string, db *gorm.DB) (WipLeases, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	var leases WipLeases
+	tx := db.Order("start_idx").Find(&leases, "indexer_id = ?", id)
+	return leases, tx.Error
+}
+
+func acquireLeases(sections Sections, id string, db *gorm.DB) error {
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		if err := insertLeases(sections, id, sqlTx); err != nil {
+			return err
+		}
+
+		return refreshInProgressMetrics(id, sqlTx)
+	}, id)
+}
+
+// insertLeases stores leases on (sections: Sections) using the lease config of id
+func insertLeases(sections Sections, id string, db *gorm.DB) error {
+	cfg := GetLeaseConfig(id)
+	expiresAt := leaseExpiry(cfg.TTL)
+
+	sections = MergeSections(sections)
+	if len(sections) == 0 {
+		return nil
+	}
+
+	leases := make(WipLeases, 0, len(sections))
+	for _, section := range sections {
+		leases = append(leases, WipLease{Section: section, IndexerId: id, Owner: cfg.Owner, ExpiresAt: expiresAt})
+	}
+
+	return db.CreateInBatches(&leases, 20000).Error
+}
+
+// releaseLeases removes (toRemove: Sections) from the in-progress leases of id, whatever their owner
+func releaseLeases(toRemove Sections, id string, db *gorm.DB) error {
+	toRemove = MergeSections(toRemove)
+	if len(toRemove) == 0 {
+		return nil
+	}
+
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		var leases WipLeases
+		tx := sqlTx.Find(&leases, "indexer_id = ? AND start_idx <= ? AND end_idx >= ?",
+			id, toRemove[len(toRemove)-1].EndIdx, toRemove[0].StartIdx)
+		if tx.Error != nil {
+			return tx.Error
+		}
+
+		var released []uint64
+		var remaining WipLeases
+		for _, lease := range leases {
+			sections := RemoveSections(Sections{lease.Section}, toRemove)
+			if len(sections) == 1 && sections[0] == lease.Section {
+				continue
+			}
+
+			released = append(released, lease.ID)
+			for _, section := range sections {
+				remaining = append(remaining, WipLease{Section: section, IndexerId: id, Owner: lease.Owner, ExpiresAt: lease.ExpiresAt})
+			}
+		}
+
+		if len(released) == 0 {
+			return nil
+		}
+
+		if err := sqlTx.Delete(&WipLeases{}, released).Error; err != nil {
+			return err
+		}
+
+		if err := sqlTx.CreateInBatches(&remaining, 20000).Error; err != nil {
+			return err
+		}
+
+		return refreshInProgressMetrics(id, sqlTx)
+	}, id)
+}
+
+// readInProgress returns the merged sections of the leases of id which did not expire
+func readInProgress(id string, db *gorm.DB) (Sections, error) {
+	var sections Sections
+	tx := db.Model(&WipLease{}).Find(&sections, "indexer_id = ? AND (expires_at IS NULL OR expires_at >= ?)", id, time.Now())
+
+	return MergeSections(sections), tx.Error
+}
+
+// clearLegacyInProgress removes the in-progress heights stored with the '_wip' suffix by previous versions
+func clearLegacyInProgress(id string, db *gorm.DB) error {
+	tx := db.Delete(&DbSections{}, "indexer_id = ?", id+WipStr)
+	if tx.Error != nil {
+		zap.S().Errorf("[ClearInProgress]- %v", tx.Error.Error())
+		return tx.Error
+	}
+
+	return refreshInProgressMetrics(id, db)
+}
+
+func refreshInProgressMetrics(id string, db *gorm.DB) error {
+	sections, err := readInProgress(id, db)
+	if err != nil {
+		return err
+	}
+
+	publish(db, func() { setInProgressMetrics(id, sections) })
+	return nil
+}
+
+func leaseExpiry(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	return &expiresAt
+}
@@ -0,0 +1,113 @@
+package tracker
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// trackerLockPrefix namespaces the advisory locks of the tracker ids
+const trackerLockPrefix = "zindexer_tracker:"
+
+type pendingUpdatesKey struct{}
+
+// pendingUpdates are the metric and progress updates of the tracker writes made in a transaction
+type pendingUpdates struct {
+	mutex   sync.Mutex
+	updates []func()
+}
+
+// withTrackerLock runs fn in a transaction holding the lock of ids. The lock serializes the writes of the tracker
+// of an id across instances, and is held until the outermost transaction commits, so a write made inside the
+// transaction of a caller cannot be overwritten by one reading the rows before it commits.
+// updateMutex is taken once the lock is held, so no goroutine waits on the database while holding it
+func withTrackerLock(db *gorm.DB, fn func(sqlTx *gorm.DB) error, ids ...string) error {
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+
+	return transaction(db, func(sqlTx *gorm.DB) error {
+		for i, id := range ids {
+			if i > 0 && id == ids[i-1] {
+				continue
+			}
+
+			if err := sqlTx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", trackerLockPrefix+id).Error; err != nil {
+				return err
+			}
+		}
+
+		updateMutex.Lock()
+		defer updateMutex.Unlock()
+
+		return fn(sqlTx)
+	})
+}
+
+// transaction runs fn in a transaction of db. When it is the outermost transaction, the updates of the tracker
+// writes made in it are published once it commits
+func transaction(db *gorm.DB, fn func(sqlTx *gorm.DB) error) error {
+	if committer, ok := db.Statement.ConnPool.(gorm.TxCommitter); (ok && committer != nil) || pendingOf(db) != nil {
+		return db.Transaction(fn)
+	}
+
+	ctx := context.Background()
+	if db.Statement.Context != nil {
+		ctx = db.Statement.Context
+	}
+	ctx = DeferUpdates(ctx)
+
+	if err := db.WithContext(ctx).Transaction(fn); err != nil {
+		return err
+	}
+
+	PublishUpdates(ctx)
+	return nil
+}
+
+// DeferUpdates returns a context whose tracker writes hold back their metric and progress updates until
+// PublishUpdates is called. Use it for the transaction of the tracker writes, so a rollback does not leave
+// the metrics and progress updated
+func DeferUpdates(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pendingUpdatesKey{}, &pendingUpdates{})
+}
+
+// PublishUpdates applies the updates held back by ctx. It is called once the transaction commits
+func PublishUpdates(ctx context.Context) {
+	pending, ok := ctx.Value(pendingUpdatesKey{}).(*pendingUpdates)
+	if !ok {
+		return
+	}
+
+	pending.mutex.Lock()
+	updates := pending.updates
+	pending.updates = nil
+	pending.mutex.Unlock()
+
+	for _, update := range updates {
+		update()
+	}
+}
+
+// publish applies update now, or holds it back if the context of db defers updates
+func publish(db *gorm.DB, update func()) {
+	pending := pendingOf(db)
+	if pending == nil {
+		update()
+		return
+	}
+
+	pending.mutex.Lock()
+	pending.updates = append(pending.updates, update)
+	pending.mutex.Unlock()
+}
+
+func pendingOf(db *gorm.DB) *pendingUpdates {
+	if db.Statement == nil || db.Statement.Context == nil {
+		return nil
+	}
+
+	pending, _ := db.Statement.Context.Value(pendingUpdatesKey{}).(*pendingUpdates)
+	return pending
+}
@@ -1,75 +1,68 @@
 package tracker
 
 import (
-	"fmt"
 	"github.com/Zondax/zindexer/components/connections/zmetrics"
 	"go.uber.org/zap"
-	"regexp"
-	"strings"
+	"sync"
 )
 
+type trackerMetrics struct {
+	trackedHeights zmetrics.GaugeVec
+	wipHeights     zmetrics.GaugeVec
+	sections       zmetrics.GaugeVec
+	trackedTip     zmetrics.GaugeVec
+	missingHeights zmetrics.GaugeVec
+}
+
 var (
-	metricsMap    = make(map[string]*zmetrics.Gauge)
-	matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
-	matchAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+	metrics     trackerMetrics
+	metricsOnce sync.Once
 )
 
-func setTotalMissingHeightsMetric(id string, count int) {
-	ind := getOrCreateIndicator(id)
-	if ind == nil {
-		zap.S().Warnf("Could not update metrics dor id '%s', nil indicator found!", id)
-		return
-	}
-
-	(*ind).Set(float64(count))
+func getMetrics() *trackerMetrics {
+	metricsOnce.Do(registerMetrics)
+	return &metrics
 }
 
-func updateMissingHeights(id string, delta int) {
-	ind := getOrCreateIndicator(id)
-	if ind == nil {
-		zap.S().Warnf("Could not update metrics dor id '%s', nil indicator found!", id)
-		return
+// setSectionsMetrics updates the metrics of id from the sections tracked for it, which must be merged
+func setSectionsMetrics(id string, sections Sections) {
+	m := getMetrics()
+
+	var tip uint64
+	if len(sections) > 0 {
+		tip = sections[len(sections)-1].EndIdx
 	}
 
-	(*ind).Sub(float64(delta))
+	m.trackedHeights.WithLabelValues(id).Set(float64(countSectionsHeights(sections)))
+	m.sections.WithLabelValues(id).Set(float64(len(sections)))
+	m.trackedTip.WithLabelValues(id).Set(float64(tip))
 }
 
-func createNewIndicator(id string) (error, *zmetrics.Gauge) {
-	m := zmetrics.NewGauge(zmetrics.GaugeOpts{
-		Namespace: "zindexer",
-		Subsystem: "tracker",
-		Name:      formatIdForName(id),
-		Help:      fmt.Sprintf("Remaning blocks for indexer %s", id),
-	})
-
-	m.Set(0)
-	err := zmetrics.RegisterMetric(m)
-	if err != nil {
-		zap.S().Errorf("Could not register Metric for id: %s", id)
-		return err, nil
-	}
-
-	metricsMap[id] = &m
-	return nil, &m
+// setInProgressMetrics updates the WIP metric of id from its in-progress sections, which must be merged
+func setInProgressMetrics(id string, sections Sections) {
+	getMetrics().wipHeights.WithLabelValues(id).Set(float64(countSectionsHeights(sections)))
 }
 
-func getOrCreateIndicator(id string) *zmetrics.Gauge {
-	if ind, ok := metricsMap[id]; ok {
-		return ind
-	}
+func registerMetrics() {
+	newGauge := func(name, help string) zmetrics.GaugeVec {
+		g := zmetrics.NewVecGauge(zmetrics.GaugeOpts{
+			Namespace: "zindexer",
+			Subsystem: "tracker",
+			Name:      name,
+			Help:      help,
+		}, []string{"id"})
 
-	err, ind := createNewIndicator(id)
-	if err != nil {
-		zap.S().Warnf("Could not create indicator: %v", err)
-		return nil
+		if err := zmetrics.RegisterMetric(g); err != nil {
+			zap.S().Errorf("Could not register Metric: %s", name)
+		}
+		return g
 	}
 
-	return ind
-}
-
-func formatIdForName(name string) string {
-	s := matchFirstCap.ReplaceAllString(name, "${1}_${2}")
-	s = matchAllCap.ReplaceAllString(s, "${1}_${2}")
-	s = strings.ToLower(s)
-	return fmt.Sprintf("remaning_blocks_%s", s)
+	metrics = trackerMetrics{
+		trackedHeights: newGauge("tracked_heights", "Heights tracked"),
+		wipHeights:     newGauge("wip_heights", "Heights in progress"),
+		sections:       newGauge("sections", "Sections of contiguous tracked heights"),
+		trackedTip:     newGauge("tracked_tip", "Highest tracked height"),
+		missingHeights: newGauge("missing_heights", "Heights between genesis and chain tip not tracked, or tracked with an outdated version"),
+	}
 }
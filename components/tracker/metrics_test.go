@@ -0,0 +1,81 @@
+package tracker
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTracker_SectionsMetrics(t *testing.T) {
+	setSectionsMetrics("metrics_test", Sections{{0, 9}, {20, 24}})
+	setInProgressMetrics("metrics_test", Sections{{10, 12}})
+
+	m := getMetrics()
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"tracked heights", testutil.ToFloat64(m.trackedHeights.WithLabelValues("metrics_test")), 15},
+		{"sections", testutil.ToFloat64(m.sections.WithLabelValues("metrics_test")), 2},
+		{"tracked tip", testutil.ToFloat64(m.trackedTip.WithLabelValues("metrics_test")), 24},
+		{"wip heights", testutil.ToFloat64(m.wipHeights.WithLabelValues("metrics_test")), 3},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s - got: %v, want: %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestTracker_MissingHeightsMetric(t *testing.T) {
+	UpdateChainTip("missing_test", 99, 0)
+	recordProgress("missing_test", Sections{{0, 49}}, nil, 50)
+
+	gauge := func() float64 {
+		return testutil.ToFloat64(getMetrics().missingHeights.WithLabelValues("missing_test"))
+	}
+	if got := gauge(); got != 50 {
+		t.Errorf("missing heights - got: %v, want: 50", got)
+	}
+
+	// it follows the tracked heights, not only the calls to GetMissingHeights
+	recordProgress("missing_test", Sections{{0, 89}}, nil, 40)
+	if got := gauge(); got != 10 {
+		t.Errorf("missing heights - got: %v, want: 10", got)
+	}
+
+	// heights tracked with an outdated version are still missing
+	recordProgress("missing_test", Sections{{0, 89}}, Sections{{80, 89}}, 0)
+	if got := gauge(); got != 20 {
+		t.Errorf("missing heights - got: %v, want: 20", got)
+	}
+}
+
+func TestTracker_ForgetIdMetrics(t *testing.T) {
+	setSectionsMetrics("renamed_test", Sections{{0, 9}})
+	setInProgressMetrics("renamed_test", Sections{{10, 12}})
+	UpdateChainTip("renamed_test", 99, 0)
+
+	forgetIdMetrics("renamed_test")
+
+	// deleting again fails if the series were removed
+	m := getMetrics()
+	for name, vec := range map[string]interface{ DeleteLabelValues(...string) bool }{
+		"tracked heights":          m.trackedHeights,
+		"wip heights":              m.wipHeights,
+		"sections":                 m.sections,
+		"tracked tip":              m.trackedTip,
+		"missing heights":          m.missingHeights,
+		"progress tracked heights": progressGauges.trackedHeights,
+	} {
+		if vec.DeleteLabelValues("renamed_test") {
+			t.Errorf("%s - series of the renamed id still exported", name)
+		}
+	}
+
+	if _, ok := progressStates["renamed_test"]; ok {
+		t.Errorf("progress state of the renamed id still kept")
+	}
+}
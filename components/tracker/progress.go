@@ -0,0 +1,230 @@
+package tracker
+
+import (
+	"github.com/Zondax/zindexer/components/connections/zmetrics"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// ProgressWindows are the sliding windows used to compute the indexing rate
+var ProgressWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// etaWindow is the window whose rate is used to estimate the time to completion
+const etaWindow = 5 * time.Minute
+
+// Progress summarizes the indexing progress of a tracker id. MissingHeights also counts the heights tracked
+// with an outdated version
+type Progress struct {
+	Id              string             `json:"id"`
+	GenesisHeight   uint64             `json:"genesis_height"`
+	ChainTip        uint64             `json:"chain_tip"`
+	TrackedTip      uint64             `json:"tracked_tip"`
+	TrackedHeights  uint64             `json:"tracked_heights"`
+	TotalHeights    uint64             `json:"total_heights"`
+	MissingHeights  uint64             `json:"missing_heights"`
+	Lag             uint64             `json:"lag"`
+	BlocksPerSecond map[string]float64 `json:"blocks_per_second"`
+	// ETASeconds is the estimated time to completion, or -1 if it cannot be estimated
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+type progressSample struct {
+	timestamp time.Time
+	count     uint64
+}
+
+type progressState struct {
+	start         time.Time
+	samples       []progressSample
+	sections      Sections
+	outdated      Sections // tracked with an outdated version, so still missing
+	genesisHeight uint64
+	chainTip      uint64
+}
+
+type progressMetrics struct {
+	trackedHeights  zmetrics.GaugeVec
+	totalHeights    zmetrics.GaugeVec
+	lag             zmetrics.GaugeVec
+	blocksPerSecond zmetrics.GaugeVec
+	eta             zmetrics.GaugeVec
+}
+
+var (
+	progressMutex      sync.Mutex
+	progressStates     = make(map[string]*progressState)
+	progressGauges     progressMetrics
+	progressMetricOnce sync.Once
+)
+
+// UpdateChainTip records the current chain tip and genesis height of id, used to compute its progress.
+// It is called by GetMissingHeights, indexers not using it should call it whenever the chain tip changes
+func UpdateChainTip(id string, chainTip uint64, genesisHeight uint64) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	state := getOrCreateProgressState(id)
+	state.chainTip = chainTip
+	state.genesisHeight = genesisHeight
+
+	publishProgress(computeProgress(id, state, time.Now()))
+}
+
+// GetProgress returns the current indexing progress of id
+func GetProgress(id string) Progress {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	return computeProgress(id, getOrCreateProgressState(id), time.Now())
+}
+
+// recordProgress stores the sections tracked for id, the ones of them with an outdated version, and the amount
+// of heights newly tracked
+func recordProgress(id string, sections Sections, outdated Sections, newHeights uint64) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	now := time.Now()
+	state := getOrCreateProgressState(id)
+	state.sections = sections
+	state.outdated = outdated
+	if newHeights > 0 {
+		state.samples = append(state.samples, progressSample{timestamp: now, count: newHeights})
+	}
+	state.prune(now)
+
+	publishProgress(computeProgress(id, state, now))
+}
+
+// forgetProgress removes the progress state and metrics of id
+func forgetProgress(id string) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	delete(progressStates, id)
+
+	progressMetricOnce.Do(registerProgressMetrics)
+	progressGauges.trackedHeights.DeleteLabelValues(id)
+	progressGauges.totalHeights.DeleteLabelValues(id)
+	progressGauges.lag.DeleteLabelValues(id)
+	progressGauges.eta.DeleteLabelValues(id)
+	for _, window := range ProgressWindows {
+		progressGauges.blocksPerSecond.DeleteLabelValues(id, window.String())
+	}
+}
+
+func getOrCreateProgressState(id string) *progressState {
+	state, ok := progressStates[id]
+	if !ok {
+		state = &progressState{start: time.Now()}
+		progressStates[id] = state
+	}
+
+	return state
+}
+
+// prune drops the samples older than the largest progress window
+func (s *progressState) prune(now time.Time) {
+	maxWindow := ProgressWindows[len(ProgressWindows)-1]
+
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].timestamp) > maxWindow {
+		i++
+	}
+	s.samples = s.samples[i:]
+}
+
+// rate returns the amount of heights tracked per second during the last 'window'
+func (s *progressState) rate(window time.Duration, now time.Time) float64 {
+	elapsed := now.Sub(s.start)
+	if elapsed > window {
+		elapsed = window
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+
+	var count uint64
+	for _, sample := range s.samples {
+		if now.Sub(sample.timestamp) <= window {
+			count += sample.count
+		}
+	}
+
+	return float64(count) / elapsed.Seconds()
+}
+
+func computeProgress(id string, s *progressState, now time.Time) Progress {
+	p := Progress{
+		Id:              id,
+		GenesisHeight:   s.genesisHeight,
+		ChainTip:        s.chainTip,
+		BlocksPerSecond: make(map[string]float64, len(ProgressWindows)),
+		ETASeconds:      -1,
+	}
+
+	if len(s.sections) > 0 {
+		p.TrackedTip = s.sections[len(s.sections)-1].EndIdx
+	}
+
+	if s.chainTip >= s.genesisHeight {
+		p.TotalHeights = s.chainTip - s.genesisHeight + 1
+		chain := Sections{{StartIdx: s.genesisHeight, EndIdx: s.chainTip}}
+		p.TrackedHeights = countSectionsHeights(IntersectSections(s.sections, chain))
+		p.MissingHeights = p.TotalHeights - p.TrackedHeights + countSectionsHeights(IntersectSections(s.outdated, chain))
+	}
+
+	if s.chainTip > p.TrackedTip {
+		p.Lag = s.chainTip - p.TrackedTip
+	}
+
+	for _, window := range ProgressWindows {
+		p.BlocksPerSecond[window.String()] = s.rate(window, now)
+	}
+
+	if p.MissingHeights == 0 && p.TotalHeights > 0 {
+		p.ETASeconds = 0
+	} else if r := s.rate(etaWindow, now); r > 0 {
+		p.ETASeconds = float64(p.MissingHeights) / r
+	}
+
+	return p
+}
+
+func publishProgress(p Progress) {
+	progressMetricOnce.Do(registerProgressMetrics)
+
+	progressGauges.trackedHeights.WithLabelValues(p.Id).Set(float64(p.TrackedHeights))
+	progressGauges.totalHeights.WithLabelValues(p.Id).Set(float64(p.TotalHeights))
+	getMetrics().missingHeights.WithLabelValues(p.Id).Set(float64(p.MissingHeights))
+	progressGauges.lag.WithLabelValues(p.Id).Set(float64(p.Lag))
+	progressGauges.eta.WithLabelValues(p.Id).Set(p.ETASeconds)
+	for window, rate := range p.BlocksPerSecond {
+		progressGauges.blocksPerSecond.WithLabelValues(p.Id, window).Set(rate)
+	}
+}
+
+func registerProgressMetrics() {
+	newGauge := func(name, help string, labels ...string) zmetrics.GaugeVec {
+		g := zmetrics.NewVecGauge(zmetrics.GaugeOpts{
+			Namespace: "zindexer",
+			Subsystem: "progress",
+			Name:      name,
+			Help:      help,
+		}, append([]string{"id"}, labels...))
+
+		if err := zmetrics.RegisterMetric(g); err != nil {
+			zap.S().Errorf("Could not register Metric: %s", name)
+		}
+		return g
+	}
+
+	progressGauges = progressMetrics{
+		trackedHeights:  newGauge("tracked_heights", "Tracked heights between genesis and chain tip"),
+		totalHeights:    newGauge("total_heights", "Total heights between genesis and chain tip"),
+		lag:             newGauge("lag_blocks", "Blocks between the tracked tip and the chain tip"),
+		blocksPerSecond: newGauge("blocks_per_second", "Heights tracked per second over a sliding window", "window"),
+		eta:             newGauge("eta_seconds", "Estimated seconds to complete indexing, -1 if unknown"),
+	}
+}
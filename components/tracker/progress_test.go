@@ -0,0 +1,42 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker_ComputeProgress(t *testing.T) {
+	now := time.Now()
+	state := &progressState{
+		start:         now.Add(-10 * time.Minute),
+		sections:      Sections{{0, 49}, {60, 89}},
+		genesisHeight: 10,
+		chainTip:      109,
+		samples: []progressSample{
+			{timestamp: now.Add(-4 * time.Minute), count: 60},
+			{timestamp: now.Add(-30 * time.Second), count: 30},
+		},
+	}
+
+	p := computeProgress(testingId, state, now)
+
+	if p.TotalHeights != 100 || p.TrackedHeights != 70 || p.MissingHeights != 30 {
+		t.Errorf("unexpected height counts: %+v", p)
+	}
+
+	if p.TrackedTip != 89 || p.Lag != 20 {
+		t.Errorf("unexpected tip or lag: %+v", p)
+	}
+
+	if got := p.BlocksPerSecond[time.Minute.String()]; got != 0.5 {
+		t.Errorf("unexpected 1m rate, got: %v, want: %v", got, 0.5)
+	}
+
+	if got := p.BlocksPerSecond[(5 * time.Minute).String()]; got != 0.3 {
+		t.Errorf("unexpected 5m rate, got: %v, want: %v", got, 0.3)
+	}
+
+	if p.ETASeconds != 100 {
+		t.Errorf("unexpected ETA, got: %v, want: %v", p.ETASeconds, 100)
+	}
+}
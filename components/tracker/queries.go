@@ -0,0 +1,110 @@
+package tracker
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IsTracked returns whether height is tracked for id
+func IsTracked(height uint64, id string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&DbSection{}).
+		Where("indexer_id = ? AND data_type = ? AND start_idx <= ? AND end_idx >= ?", id, "", height, height).
+		Count(&count)
+	if tx.Error != nil {
+		zap.S().Errorf("[IsTracked] - %v", tx.Error)
+		return false, tx.Error
+	}
+
+	return count > 0, nil
+}
+
+// CountTracked returns the amount of heights tracked for id in the range [from, to]
+func CountTracked(from uint64, to uint64, id string, db *gorm.DB) (uint64, error) {
+	if err := checkRange(from, to); err != nil {
+		return 0, err
+	}
+
+	// Stored sections of an id do not overlap, so the clamped lengths can be summed
+	var count uint64
+	tx := db.Model(&DbSection{}).
+		Select("COALESCE(SUM(LEAST(end_idx, ?) - GREATEST(start_idx, ?) + 1), 0)", to, from).
+		Where("indexer_id = ? AND data_type = ? AND start_idx <= ? AND end_idx >= ?", id, "", to, from).
+		Scan(&count)
+	if tx.Error != nil {
+		zap.S().Errorf("[CountTracked] - %v", tx.Error)
+		return 0, tx.Error
+	}
+
+	return count, nil
+}
+
+// GetTrackedSections returns the sections tracked for id in the range [from, to], clamped to it
+func GetTrackedSections(from uint64, to uint64, id string, db *gorm.DB) (Sections, error) {
+	if err := checkRange(from, to); err != nil {
+		return nil, err
+	}
+
+	var sections Sections
+	tx := db.Model(&DbSection{}).
+		Select("GREATEST(start_idx, ?) AS start_idx, LEAST(end_idx, ?) AS end_idx", from, to).
+		Where("indexer_id = ? AND data_type = ? AND start_idx <= ? AND end_idx >= ?", id, "", to, from).
+		Order("start_idx").
+		Scan(&sections)
+	if tx.Error != nil {
+		zap.S().Errorf("[GetTrackedSections] - %v", tx.Error)
+		return nil, tx.Error
+	}
+
+	// Sections tracked with different versions may be contiguous
+	return MergeSections(sections), nil
+}
+
+// FirstGap returns the lowest height greater than 'after' which is not tracked for id
+func FirstGap(after uint64, id string, db *gorm.DB) (uint64, error) {
+	tracked, err := IsTracked(after+1, id, db)
+	if err != nil {
+		return 0, err
+	}
+
+	if !tracked {
+		return after + 1, nil
+	}
+
+	// Otherwise, the gap starts right after the end of a section not followed by a contiguous one
+	table := clause.Table{Name: DbSection{}.TableName()}
+	var gap uint64
+	tx := db.Raw(`SELECT COALESCE(MIN(s.end_idx + 1), 0) FROM ? AS s
+		WHERE s.indexer_id = ? AND s.data_type = ? AND s.end_idx > ?
+		AND NOT EXISTS (
+			SELECT 1 FROM ? AS n
+			WHERE n.indexer_id = s.indexer_id AND n.data_type = s.data_type AND n.start_idx = s.end_idx + 1
+		)`, table, id, "", after, table).Scan(&gap)
+	if tx.Error != nil {
+		zap.S().Errorf("[FirstGap] - %v", tx.Error)
+		return 0, tx.Error
+	}
+
+	return gap, nil
+}
+
+// CoveragePercent returns the percentage of heights tracked for id in the range [from, to]
+func CoveragePercent(from uint64, to uint64, id string, db *gorm.DB) (float64, error) {
+	count, err := CountTracked(from, to, id, db)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(count) * 100 / float64(to-from+1), nil
+}
+
+func checkRange(from uint64, to uint64) error {
+	if from > to {
+		return fmt.Errorf("invalid range: 'from' (%d) is greater than 'to' (%d)", from, to)
+	}
+
+	return nil
+}
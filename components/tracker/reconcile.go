@@ -0,0 +1,128 @@
+package tracker
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReconcileConfig defines the destination table checked against the tracker
+type ReconcileConfig struct {
+	Table        string // Table holding the indexed data, with schema if needed
+	HeightColumn string // Column of Table holding the height of each row
+	DataType     string // Sub-tracker to reconcile. Empty for the indexer tracker
+	From         uint64 // First height to reconcile. From and To set to 0 reconcile all heights
+	To           uint64 // Last height to reconcile (inclusive)
+	Repair       bool   // If set, the tracker is updated to match the heights present in Table
+}
+
+// ReconcileReport holds the differences found between the tracker and the destination table
+type ReconcileReport struct {
+	Id                  string
+	Table               string
+	DataSections        Sections // Heights present in the table
+	TrackedWithoutData  Sections // Heights tracked but not present in the table
+	DataWithoutTracking Sections // Heights present in the table but not tracked
+	Repaired            bool
+}
+
+// Reconcile compares the heights tracked for id with the heights actually present in the configured table.
+// If cfg.Repair is set, heights without data are removed from the tracker and untracked heights with data are tracked
+func Reconcile(id string, cfg ReconcileConfig, db *gorm.DB) (*ReconcileReport, error) {
+	if cfg.Table == "" || cfg.HeightColumn == "" {
+		return nil, fmt.Errorf("reconcile requires a table and a height column")
+	}
+
+	if cfg.From > cfg.To {
+		return nil, fmt.Errorf("invalid range: 'from' (%d) is greater than 'to' (%d)", cfg.From, cfg.To)
+	}
+
+	// the heights are read and repaired under the tracker lock, so concurrent tracker writes are not overwritten
+	var report *ReconcileReport
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		dataSections, err := readHeightSections(cfg, sqlTx)
+		if err != nil {
+			zap.S().Errorf("[Reconcile] - could not read heights from table '%s': %v", cfg.Table, err)
+			return err
+		}
+
+		sectionId, err := readDb(id, cfg.DataType, sqlTx)
+		if err != nil {
+			return err
+		}
+
+		tracked := MergeSections(sectionId.Sections)
+		if cfg.isBounded() {
+			tracked = IntersectSections(tracked, Sections{{StartIdx: cfg.From, EndIdx: cfg.To}})
+		}
+
+		report = &ReconcileReport{
+			Id:                  id,
+			Table:               cfg.Table,
+			DataSections:        dataSections,
+			TrackedWithoutData:  RemoveSections(tracked, dataSections),
+			DataWithoutTracking: RemoveSections(dataSections, tracked),
+		}
+
+		zap.S().Infof("[Reconcile] - id '%s', table '%s': %d heights tracked without data, %d heights with data not tracked",
+			id, cfg.Table, countSectionsHeights(report.TrackedWithoutData), countSectionsHeights(report.DataWithoutTracking))
+
+		if !cfg.Repair {
+			return nil
+		}
+
+		// both repairs are applied, or none
+		if len(report.TrackedWithoutData) > 0 {
+			if err = untrackSections(report.TrackedWithoutData, id, cfg.DataType, sqlTx); err != nil {
+				return err
+			}
+		}
+
+		if len(report.DataWithoutTracking) > 0 {
+			if err = trackSections(report.DataWithoutTracking, id, cfg.DataType, sqlTx); err != nil {
+				return err
+			}
+		}
+
+		report.Repaired = true
+		return nil
+	}, id)
+	if err != nil {
+		if report != nil {
+			zap.S().Errorf("[Reconcile] - could not repair the tracker of id '%s': %v", id, err)
+			report.Repaired = false
+		}
+		return report, err
+	}
+
+	return report, nil
+}
+
+func (cfg ReconcileConfig) isBounded() bool {
+	return cfg.From != 0 || cfg.To != 0
+}
+
+// readHeightSections returns the distinct heights present in the table as sections. Consecutive heights are
+// grouped on the database side, so they do not need to be loaded one by one
+func readHeightSections(cfg ReconcileConfig, db *gorm.DB) (Sections, error) {
+	var sections Sections
+
+	column := clause.Column{Name: cfg.HeightColumn}
+	vars := []interface{}{column, clause.Table{Name: cfg.Table}}
+
+	where := ""
+	if cfg.isBounded() {
+		where = "WHERE ? BETWEEN ? AND ?"
+		vars = append(vars, column, cfg.From, cfg.To)
+	}
+
+	query := fmt.Sprintf(`SELECT MIN(height) AS start_idx, MAX(height) AS end_idx FROM (
+		SELECT height, height - ROW_NUMBER() OVER (ORDER BY height) AS island FROM (
+			SELECT DISTINCT ? AS height FROM ? %s
+		) AS h
+	) AS i GROUP BY island ORDER BY start_idx`, where)
+
+	tx := db.Raw(query, vars...).Scan(&sections)
+	return sections, tx.Error
+}
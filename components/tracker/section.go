@@ -7,8 +7,8 @@ import (
 
 // Section defines an interval of heights with inclusive boundaries [StartIdx, EndIdx]
 type Section struct {
-	StartIdx uint64
-	EndIdx   uint64
+	StartIdx uint64 `json:"start_idx"`
+	EndIdx   uint64 `json:"end_idx"`
 }
 
 type Sections = []Section
@@ -85,6 +85,21 @@ func FindGapsInSections(sections Sections) *[]uint64 {
 	return &missing
 }
 
+// FindGapSections returns the sections of heights not covered between the first and last of (sections: Sections)
+func FindGapSections(sections Sections) Sections {
+	var gaps Sections
+
+	sections = MergeSections(sections)
+	for i := 1; i < len(sections); i++ {
+		gaps = append(gaps, Section{
+			StartIdx: sections[i-1].EndIdx + 1,
+			EndIdx:   sections[i].StartIdx - 1,
+		})
+	}
+
+	return gaps
+}
+
 func MergeSections(sections Sections) Sections {
 	var merged Sections
 
@@ -125,33 +140,82 @@ func MergeSections(sections Sections) Sections {
 	return merged
 }
 
-// RemoveSections removes any sections included in (toRemove: Sections) that intersect with (sections: Sections)
-func RemoveSections(sections, toRemove Sections) Sections {
-	sectionsFlat := BuildSliceFromSections(sections)
-	toRemoveFlat := BuildSliceFromSections(toRemove)
+// IntersectSections returns the sections of heights contained both in (a: Sections) and (b: Sections)
+func IntersectSections(a, b Sections) Sections {
+	var result Sections
 
-	resultFlat := make([]uint64, 0, len(*sectionsFlat))
+	a = MergeSections(a)
+	b = MergeSections(b)
 
 	i := 0
 	j := 0
+	for i < len(a) && j < len(b) {
+		start := a[i].StartIdx
+		if b[j].StartIdx > start {
+			start = b[j].StartIdx
+		}
 
-	for i < len(*sectionsFlat) && j < len(*toRemoveFlat) {
-		if (*sectionsFlat)[i] == (*toRemoveFlat)[j] {
-			i++
-			j++
-			continue
+		end := a[i].EndIdx
+		if b[j].EndIdx < end {
+			end = b[j].EndIdx
 		}
 
-		if (*sectionsFlat)[i] < (*toRemoveFlat)[j] {
-			resultFlat = append(resultFlat, (*sectionsFlat)[i])
+		if start <= end {
+			result = append(result, Section{StartIdx: start, EndIdx: end})
+		}
+
+		if a[i].EndIdx < b[j].EndIdx {
 			i++
 		} else {
 			j++
 		}
 	}
 
-	resultFlat = append(resultFlat, (*sectionsFlat)[i:]...)
-	result := BuildSectionsFromSlice(&resultFlat)
+	return result
+}
+
+// countSectionsHeights returns the amount of heights contained in (sections: Sections), which must be merged
+func countSectionsHeights(sections Sections) uint64 {
+	var count uint64
+	for _, section := range sections {
+		count += section.EndIdx - section.StartIdx + 1
+	}
+
+	return count
+}
+
+// RemoveSections removes any sections included in (toRemove: Sections) that intersect with (sections: Sections)
+func RemoveSections(sections, toRemove Sections) Sections {
+	var result Sections
+
+	sections = MergeSections(sections)
+	toRemove = MergeSections(toRemove)
+
+	j := 0
+	for _, section := range sections {
+		// skip the sections to remove placed before this one
+		for j < len(toRemove) && toRemove[j].EndIdx < section.StartIdx {
+			j++
+		}
+
+		start := section.StartIdx
+		covered := false
+		for k := j; k < len(toRemove) && toRemove[k].StartIdx <= section.EndIdx; k++ {
+			if toRemove[k].StartIdx > start {
+				result = append(result, Section{StartIdx: start, EndIdx: toRemove[k].StartIdx - 1})
+			}
+
+			if toRemove[k].EndIdx >= section.EndIdx {
+				covered = true
+				break
+			}
+			start = toRemove[k].EndIdx + 1
+		}
+
+		if !covered {
+			result = append(result, Section{StartIdx: start, EndIdx: section.EndIdx})
+		}
+	}
 
 	return result
 }
@@ -171,6 +171,16 @@ func TestTracer_RemoveSection(t *testing.T) {
 			Sections{{StartIdx: 0, EndIdx: 0}, {StartIdx: 8, EndIdx: 9},
 				{StartIdx: 23, EndIdx: 50}, {StartIdx: 52, EndIdx: 59}},
 		},
+		{
+			Sections{{StartIdx: 5, EndIdx: 10}},
+			Sections{{StartIdx: 0, EndIdx: 20}},
+			nil,
+		},
+		{
+			Sections{{StartIdx: 5, EndIdx: 10}, {StartIdx: 12, EndIdx: 15}},
+			Sections{{StartIdx: 20, EndIdx: 30}},
+			Sections{{StartIdx: 5, EndIdx: 10}, {StartIdx: 12, EndIdx: 15}},
+		},
 	}
 
 	for _, test := range tests {
@@ -181,3 +191,72 @@ func TestTracer_RemoveSection(t *testing.T) {
 		}
 	}
 }
+
+func TestTracker_FindGapSections(t *testing.T) {
+	tests := []struct {
+		sections Sections
+		want     Sections
+	}{
+		{
+			Sections{{1, 3}, {2, 6}, {8, 10}, {15, 18}},
+			Sections{{7, 7}, {11, 14}},
+		},
+		{
+			Sections{{0, 0}, {5, 5}},
+			Sections{{1, 4}},
+		},
+		{
+			Sections{{1, 1}, {2, 2}},
+			nil,
+		},
+		{
+			Sections{{4, 4}},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got := FindGapSections(tt.sections)
+		fmt.Println(tt.sections, " ->", got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got: %v, want: %v", got, tt.want)
+		}
+	}
+}
+
+func TestTracker_IntersectSections(t *testing.T) {
+	tests := []struct {
+		a    Sections
+		b    Sections
+		want Sections
+	}{
+		{
+			Sections{{1, 10}, {20, 30}},
+			Sections{{5, 25}},
+			Sections{{5, 10}, {20, 25}},
+		},
+		{
+			Sections{{1, 3}, {6, 8}},
+			Sections{{4, 5}, {9, 12}},
+			nil,
+		},
+		{
+			Sections{{0, 100}},
+			Sections{{2, 2}, {50, 60}, {100, 120}},
+			Sections{{2, 2}, {50, 60}, {100, 100}},
+		},
+		{
+			Sections{{1, 5}},
+			Sections{},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got := IntersectSections(tt.a, tt.b)
+		fmt.Println(tt.a, "&", tt.b, " ->", got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got: %v, want: %v", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Zondax/zindexer/components/connections/data_store"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"time"
+)
+
+const SnapshotVersion = 1
+
+// Snapshot is a portable representation of the tracking state of an indexer
+type Snapshot struct {
+	Version    int       `json:"version"`
+	IndexerId  string    `json:"indexer_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Sections   Sections  `json:"sections"`
+	InProgress Sections  `json:"in_progress"`
+	// DataTypes holds the sections tracked for each data type of the indexer
+	DataTypes map[string]Sections `json:"data_types,omitempty"`
+	// Versions holds, by data type ("" for the indexer tracker), the sections tracked by each parser version.
+	// It is only set when a version other than 0 is used, and takes precedence over Sections and DataTypes
+	Versions map[string]VersionedSections `json:"versions,omitempty"`
+}
+
+// Export returns a snapshot of the tracked and in-progress sections of id
+func Export(id string, db *gorm.DB) (*Snapshot, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	tracked, err := readVersionedDb(id, "", db)
+	if err != nil {
+		return nil, err
+	}
+
+	inProgress, err := readInProgress(id, db)
+	if err != nil {
+		return nil, err
+	}
+
+	dataTypes, err := readDataTypes(id, db)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Version:    SnapshotVersion,
+		IndexerId:  id,
+		CreatedAt:  time.Now().UTC(),
+		InProgress: inProgress,
+	}
+	snapshot.Sections = snapshot.addVersions("", tracked)
+
+	for _, dataType := range dataTypes {
+		typed, err := readVersionedDb(id, dataType, db)
+		if err != nil {
+			return nil, err
+		}
+
+		if snapshot.DataTypes == nil {
+			snapshot.DataTypes = make(map[string]Sections, len(dataTypes))
+		}
+		snapshot.DataTypes[dataType] = snapshot.addVersions(dataType, typed)
+	}
+
+	return snapshot, nil
+}
+
+// Import replaces the tracked and in-progress sections of id with the ones in snapshot.
+// The snapshot may have been exported from a different id. In-progress sections are leased as set by SetLeaseConfig
+func Import(id string, snapshot *Snapshot, db *gorm.DB) error {
+	if err := snapshot.validate(); err != nil {
+		return err
+	}
+
+	sections := MergeSections(snapshot.Sections)
+	_, outdated := splitOutdated(snapshot.getVersions("", sections), id)
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		err := writeVersionedSections(id, "", snapshot.getVersions("", sections), sqlTx)
+		if err != nil {
+			return err
+		}
+
+		// In-progress heights are leased by this instance
+		if err = sqlTx.Delete(&WipLeases{}, "indexer_id = ?", id).Error; err != nil {
+			return err
+		}
+
+		if err = insertLeases(snapshot.InProgress, id, sqlTx); err != nil {
+			return err
+		}
+
+		// Replace all data types sub-trackers
+		if err = sqlTx.Delete(&DbSections{}, "indexer_id = ? AND data_type <> ?", id, "").Error; err != nil {
+			return err
+		}
+
+		for dataType, typed := range snapshot.DataTypes {
+			if dataType == "" {
+				return fmt.Errorf("tracker snapshot contains an empty data type")
+			}
+
+			err = writeVersionedSections(id, dataType, snapshot.getVersions(dataType, typed), sqlTx)
+			if err != nil {
+				return err
+			}
+		}
+
+		publish(sqlTx, func() {
+			setSectionsMetrics(id, sections)
+			setInProgressMetrics(id, MergeSections(snapshot.InProgress))
+			recordProgress(id, sections, outdated, 0)
+		})
+		return nil
+	}, id)
+	if err != nil {
+		zap.S().Errorf("[Import] - %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// MarshalSnapshot encodes snapshot using the versioned JSON format
+func MarshalSnapshot(snapshot *Snapshot) ([]byte, error) {
+	if err := snapshot.validate(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(snapshot)
+}
+
+// UnmarshalSnapshot decodes a snapshot encoded with MarshalSnapshot
+func UnmarshalSnapshot(data []byte) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("could not decode tracker snapshot: %w", err)
+	}
+
+	if err := snapshot.validate(); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// ExportToDataStore exports the tracking state of id and uploads it to the data store as folder/name
+func ExportToDataStore(id string, client data_store.IDataStoreClient, folder string, name string, db *gorm.DB) error {
+	snapshot, err := Export(id, db)
+	if err != nil {
+		return err
+	}
+
+	data, err := MarshalSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = client.UploadFromBytes(data, folder, name)
+	if err != nil {
+		zap.S().Errorf("[ExportToDataStore] - %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// ImportFromDataStore downloads the snapshot stored as folder/name and imports it into id
+func ImportFromDataStore(id string, client data_store.IDataStoreClient, folder string, name string, db *gorm.DB) error {
+	data, err := client.GetFile(name, folder)
+	if err != nil {
+		zap.S().Errorf("[ImportFromDataStore] - %v", err)
+		return err
+	}
+
+	snapshot, err := UnmarshalSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	return Import(id, snapshot, db)
+}
+
+// addVersions stores versioned in the snapshot if it contains a version other than 0, and returns all its sections
+func (s *Snapshot) addVersions(dataType string, versioned VersionedSections) Sections {
+	all, _ := splitByVersion(versioned, 0)
+
+	if _, ok := versioned[0]; ok && len(versioned) == 1 {
+		return all
+	}
+	if len(versioned) == 0 {
+		return all
+	}
+
+	if s.Versions == nil {
+		s.Versions = make(map[string]VersionedSections)
+	}
+	for version, sections := range versioned {
+		versioned[version] = MergeSections(sections)
+	}
+	s.Versions[dataType] = versioned
+
+	return all
+}
+
+// getVersions returns the versioned sections of dataType, or sections with version 0 if there are none
+func (s *Snapshot) getVersions(dataType string, sections Sections) VersionedSections {
+	if versioned, ok := s.Versions[dataType]; ok {
+		return versioned
+	}
+
+	return VersionedSections{0: sections}
+}
+
+func (s *Snapshot) validate() error {
+	if s == nil {
+		return fmt.Errorf("tracker snapshot is nil")
+	}
+
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported tracker snapshot version %d, expected %d", s.Version, SnapshotVersion)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package tracker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTracker_SnapshotMarshal(t *testing.T) {
+	snapshot := &Snapshot{
+		Version:    SnapshotVersion,
+		IndexerId:  testingId,
+		Sections:   Sections{{0, 10}, {15, 20}},
+		InProgress: Sections{{11, 12}},
+	}
+
+	data, err := MarshalSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := UnmarshalSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, snapshot) {
+		t.Errorf("got: %v, want: %v", got, snapshot)
+	}
+}
+
+func TestTracker_SnapshotUnsupportedVersion(t *testing.T) {
+	_, err := UnmarshalSnapshot([]byte(`{"version": 99, "sections": [{"start_idx": 1, "end_idx": 2}]}`))
+	if err == nil {
+		t.Errorf("expected error for unsupported snapshot version")
+	}
+}
@@ -10,78 +10,103 @@ import (
 type SectionId struct {
 	Sections
 	IndexerId string
+	DataType  string
+	Version   uint64
 }
 
 type DbSection struct {
 	Section
 	IndexerId string
+	// DataType is empty for the sections tracked at indexer level
+	DataType string `gorm:"not null;default:''"`
+	// Version is the parser version which produced the data of the section
+	Version uint64 `gorm:"not null;default:0"`
 }
 
 type DbSections = []DbSection
 
 const (
 	NoReturnLimit = 0
-	WipStr        = "_wip"
+	// WipStr is the suffix of the ids used by previous versions to store in-progress heights as sections
+	WipStr = "_wip"
 )
 
 var updateMutex sync.Mutex
 
 func UpdateAndRemoveWipHeights(heights *[]uint64, id string, dbConn *gorm.DB) error {
-	// Track these heights
-	err := UpdateTrackedHeights(heights, id, dbConn)
-	if err != nil {
-		return err
-	}
-
-	// Remove WIP heights
-	err = UpdateInProgressHeight(false, heights, id, dbConn)
-	if err != nil {
-		return err
-	}
+	// Track these heights and remove them from WIP together
+	return transaction(dbConn, func(sqlTx *gorm.DB) error {
+		if err := UpdateTrackedHeights(heights, id, sqlTx); err != nil {
+			return err
+		}
 
-	return nil
+		return UpdateInProgressHeight(false, heights, id, sqlTx)
+	})
 }
 
 func UpdateTrackedHeights(heights *[]uint64, id string, db *gorm.DB) error {
-	updateMutex.Lock()
-	defer updateMutex.Unlock()
+	return UpdateTrackedSections(BuildSectionsFromSlice(heights), id, db)
+}
+
+// UpdateTrackedSections merges the given sections into the ones already tracked for id
+func UpdateTrackedSections(sections Sections, id string, db *gorm.DB) error {
+	return updateTrackedSections(sections, id, "", db)
+}
 
+func updateTrackedSections(sections Sections, id string, dataType string, db *gorm.DB) error {
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		return trackSections(sections, id, dataType, sqlTx)
+	}, id)
+}
+
+// trackSections merges sections into the ones tracked for id and dataType. The tracker lock of id must be held
+func trackSections(sections Sections, id string, dataType string, sqlTx *gorm.DB) error {
 	// Get current sections stored on DB
-	sectionId, err := readDb(id, db)
-	dbSections := sectionId.Sections
+	versioned, err := readVersionedDb(id, dataType, sqlTx)
 	if err != nil {
-		zap.S().Errorf("[UpdateTrackedHeights] - %v", err)
+		zap.S().Errorf("[UpdateTrackedSections] - %v", err)
 		return err
 	}
 
-	newSections := BuildSectionsFromSlice(heights)
-	newHeights := BuildSliceFromSections(newSections)
-
-	newSections = append(newSections, dbSections...)
-	mergedSections := MergeSections(newSections)
+	newSections := MergeSections(sections)
+	// heights tracked again with the current version, after an older one, count as progress too
+	previousSections, previousOutdated := splitOutdated(versioned, id)
+	previousHeights := countSectionsHeights(previousSections) - countSectionsHeights(previousOutdated)
 
-	sectionId = SectionId{Sections: mergedSections, IndexerId: id}
+	trackVersion(versioned, newSections, GetVersionConfig(id).Version)
+	mergedSections, outdated := splitOutdated(versioned, id)
 
 	// Write new sections to db
-	err = updateDb(sectionId, db)
+	err = writeVersionedSections(id, dataType, versioned, sqlTx)
 	if err != nil {
-		zap.S().Errorf("[UpdateTrackedHeights] - %v", err)
+		zap.S().Errorf("[UpdateTrackedSections] - %v", err)
 		return err
 	}
 
-	if newHeights != nil {
-		updateMissingHeights(id, len(*newHeights))
+	if dataType == "" {
+		publish(sqlTx, func() {
+			setSectionsMetrics(id, mergedSections)
+			upToDateHeights := countSectionsHeights(mergedSections) - countSectionsHeights(outdated)
+			recordProgress(id, mergedSections, outdated, upToDateHeights-previousHeights)
+		})
 	}
 
 	return nil
 }
 
+// MigrateTypes creates or updates the tables used by the tracker
+func MigrateTypes(db *gorm.DB) error {
+	return db.AutoMigrate(DbSection{}, WipLease{})
+}
+
+// UpdateInProgressHeight takes (track = true) or releases (track = false) in-progress leases on heights.
+// Leases are taken with the owner and TTL set by SetLeaseConfig for id, and released whatever their owner
 func UpdateInProgressHeight(track bool, heights *[]uint64, id string, db *gorm.DB) error {
 	var err error
 	if track {
-		err = UpdateTrackedHeights(heights, id+WipStr, db)
+		err = acquireLeases(BuildSectionsFromSlice(heights), id, db)
 	} else {
-		err = RemoveHeights(heights, id+WipStr, db)
+		err = releaseLeases(BuildSectionsFromSlice(heights), id, db)
 	}
 
 	if err != nil {
@@ -92,37 +117,66 @@ func UpdateInProgressHeight(track bool, heights *[]uint64, id string, db *gorm.D
 	return nil
 }
 
+// ClearInProgress removes all the in-progress leases of id, whatever their owner.
+// Use ClearOwnedInProgress to only remove the ones of an instance
 func ClearInProgress(id string, db *gorm.DB) error {
-	updateMutex.Lock()
-	defer updateMutex.Unlock()
-
-	tx := db.Delete(DbSection{}, "indexer_id = ?", id+WipStr)
-	if tx.Error != nil {
-		zap.S().Errorf("[ClearInProgress]- %v", tx.Error.Error())
-		return tx.Error
-	}
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		tx := sqlTx.Delete(&WipLeases{}, "indexer_id = ?", id)
+		if tx.Error != nil {
+			zap.S().Errorf("[ClearInProgress]- %v", tx.Error.Error())
+			return tx.Error
+		}
 
-	return nil
+		return clearLegacyInProgress(id, sqlTx)
+	}, id)
 }
 
+// GetMissingHeights returns at most 'limit' heights between genesisHeight and chainTip which are not tracked for id,
+// or tracked with an outdated version, and not in progress. It waits for the tracker writes of id in progress to commit.
+// The metrics and progress of id are refreshed from the stored state read
 func GetMissingHeights(chainTip uint64, genesisHeight uint64, limit uint64, id string, db *gorm.DB) (*[]uint64, error) {
-	updateMutex.Lock()
-	defer updateMutex.Unlock()
+	var missing *[]uint64
+	err := withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		// Get current currentTracked stored on DB
+		versioned, err := readVersionedDb(id, "", sqlTx)
+		if err != nil {
+			return err
+		}
+
+		UpdateChainTip(id, chainTip, genesisHeight)
+
+		cfg := GetVersionConfig(id)
+		tracked, upToDate := splitByVersion(versioned, cfg.Version)
+		outdated := RemoveSections(tracked, upToDate)
+
+		publish(sqlTx, func() {
+			setSectionsMetrics(id, tracked)
+			recordProgress(id, tracked, outdated, 0)
+		})
 
-	// Get current currentTracked stored on DB
-	currentTracked, err := readDb(id, db)
+		missing, err = findMissingHeights(tracked, outdated, chainTip, genesisHeight, limit, cfg.ReindexPolicy, id, sqlTx)
+		return err
+	}, id)
 	if err != nil {
 		return nil, err
 	}
 
+	return missing, nil
+}
+
+// findMissingHeights returns at most 'limit' heights between genesisHeight and chainTip which are either not in
+// tracked or in outdated, and not in progress for id.
+// Never tracked heights come first in desc order, followed by the outdated ones in the order defined by policy
+func findMissingHeights(tracked Sections, outdated Sections, chainTip uint64, genesisHeight uint64, limit uint64,
+	policy ReindexPolicy, id string, db *gorm.DB) (*[]uint64, error) {
 	// Get WIP heights for this id
-	currentInProgress, err := readDb(id+WipStr, db)
+	currentInProgress, err := readInProgress(id, db)
 	if err != nil {
 		return nil, err
 	}
 
-	dbSections := currentTracked.Sections
-	dbSections = append(dbSections, currentInProgress.Sections...)
+	dbSections := append(Sections{}, tracked...)
+	dbSections = append(dbSections, currentInProgress...)
 
 	dbSections = append(dbSections,
 		Section{
@@ -135,16 +189,31 @@ func GetMissingHeights(chainTip uint64, genesisHeight uint64, limit uint64, id s
 		},
 	)
 
-	missing := FindGapsInSections(dbSections)
-	setTotalMissingHeightsMetric(id, len(*missing))
+	gaps := FindGapsInSections(dbSections)
+
+	outdated = RemoveSections(outdated, currentInProgress)
+	outdated = IntersectSections(outdated, Sections{{StartIdx: genesisHeight, EndIdx: chainTip}})
 
-	if limit != NoReturnLimit && uint64(len(*missing)) > limit {
-		l := *missing
+	missing := *limitHeights(gaps, limit)
+	if limit == NoReturnLimit || uint64(len(missing)) < limit {
+		remaining := uint64(NoReturnLimit)
+		if limit != NoReturnLimit {
+			remaining = limit - uint64(len(missing))
+		}
+		missing = append(missing, orderHeights(outdated, policy, remaining)...)
+	}
+
+	return &missing, nil
+}
+
+func limitHeights(heights *[]uint64, limit uint64) *[]uint64 {
+	if limit != NoReturnLimit && uint64(len(*heights)) > limit {
+		l := *heights
 		l = l[:limit]
-		return &l, nil
+		return &l
 	}
 
-	return missing, nil
+	return heights
 }
 
 func RemoveHeights(heights *[]uint64, id string, db *gorm.DB) error {
@@ -160,25 +229,38 @@ func RemoveHeights(heights *[]uint64, id string, db *gorm.DB) error {
 }
 
 func RemoveSectionsFromTracker(toRemove Sections, id string, db *gorm.DB) error {
-	updateMutex.Lock()
-	defer updateMutex.Unlock()
+	return removeSectionsFromTracker(toRemove, id, "", db)
+}
+
+func removeSectionsFromTracker(toRemove Sections, id string, dataType string, db *gorm.DB) error {
+	return withTrackerLock(db, func(sqlTx *gorm.DB) error {
+		return untrackSections(toRemove, id, dataType, sqlTx)
+	}, id)
+}
 
-	currentSectionId, err := readDb(id, db)
+// untrackSections removes toRemove from the sections tracked for id and dataType. The tracker lock of id must be held
+func untrackSections(toRemove Sections, id string, dataType string, sqlTx *gorm.DB) error {
+	versioned, err := readVersionedDb(id, dataType, sqlTx)
 	if err != nil {
 		return err
 	}
 
-	remainingSections := RemoveSections(currentSectionId.Sections, toRemove)
+	untrackVersions(versioned, toRemove)
+	remainingSections, outdated := splitOutdated(versioned, id)
 
-	err = updateDb(SectionId{
-		Sections:  remainingSections,
-		IndexerId: id,
-	}, db)
+	err = writeVersionedSections(id, dataType, versioned, sqlTx)
 	if err != nil {
 		zap.S().Errorf("[RemoveSectionsFromTracker] - %v", err)
 		return err
 	}
 
+	if dataType == "" {
+		publish(sqlTx, func() {
+			setSectionsMetrics(id, remainingSections)
+			recordProgress(id, remainingSections, outdated, 0)
+		})
+	}
+
 	return nil
 }
 
@@ -186,7 +268,7 @@ func GetTrackedHeights(id string, db *gorm.DB) (*[]uint64, error) {
 	updateMutex.Lock()
 	defer updateMutex.Unlock()
 
-	sectionId, err := readDb(id, db)
+	sectionId, err := readDb(id, "", db)
 	if err != nil {
 		return nil, err
 	}
@@ -195,9 +277,34 @@ func GetTrackedHeights(id string, db *gorm.DB) (*[]uint64, error) {
 	return tracked, nil
 }
 
+// GetSections returns the merged sections currently tracked for id
+func GetSections(id string, db *gorm.DB) (Sections, error) {
+	return getSections(id, "", db)
+}
+
+func getSections(id string, dataType string, db *gorm.DB) (Sections, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	sectionId, err := readDb(id, dataType, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return MergeSections(sectionId.Sections), nil
+}
+
+// GetInProgressSections returns the merged sections currently marked as in-progress for id by unexpired leases
+func GetInProgressSections(id string, db *gorm.DB) (Sections, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	return readInProgress(id, db)
+}
+
 func GetTrackedTip(db *gorm.DB, refTrackId string) (uint64, error) {
 	var tipHeight uint64
-	tx := db.Model(&Section{}).Select("COALESCE(MAX(end_idx), 0)").Find(&tipHeight, "indexer_id = ?", refTrackId)
+	tx := db.Model(&Section{}).Select("COALESCE(MAX(end_idx), 0)").Find(&tipHeight, "indexer_id = ? AND data_type = ?", refTrackId, "")
 
 	return tipHeight, tx.Error
 }
@@ -207,32 +314,40 @@ func convertSectionId(section SectionId) *DbSections {
 	result := make(DbSections, 0, len(section.Sections))
 
 	for _, sec := range section.Sections {
-		result = append(result, DbSection{IndexerId: section.IndexerId, Section: Section{StartIdx: sec.StartIdx, EndIdx: sec.EndIdx}})
+		result = append(result, DbSection{
+			IndexerId: section.IndexerId,
+			DataType:  section.DataType,
+			Version:   section.Version,
+			Section:   Section{StartIdx: sec.StartIdx, EndIdx: sec.EndIdx},
+		})
 	}
 
 	return &result
 }
 
-func readDb(id string, db *gorm.DB) (SectionId, error) {
+func readDb(id string, dataType string, db *gorm.DB) (SectionId, error) {
 	var dbSections Sections
-	tx := db.Model(&DbSection{}).Find(&dbSections, "indexer_id = ?", id)
+	tx := db.Model(&DbSection{}).Find(&dbSections, "indexer_id = ? AND data_type = ?", id, dataType)
 
-	result := SectionId{IndexerId: id, Sections: dbSections}
+	result := SectionId{IndexerId: id, DataType: dataType, Sections: dbSections}
 
 	return result, tx.Error
 }
 
-func updateDb(section SectionId, db *gorm.DB) error {
-	err := db.Transaction(func(sqlTx *gorm.DB) error {
-		if err := sqlTx.Delete(&DbSections{}, "indexer_id = ?", section.IndexerId).Error; err != nil {
-			return err
-		}
+// writeSections replaces the sections stored for section.IndexerId and section.DataType.
+// It must be called inside a transaction
+func writeSections(section SectionId, sqlTx *gorm.DB) error {
+	if err := deleteSections(section.IndexerId, section.DataType, sqlTx); err != nil {
+		return err
+	}
 
-		if err := sqlTx.CreateInBatches(convertSectionId(section), 20000).Error; err != nil {
-			return err
-		}
-		return nil
-	})
+	return insertSections(section, sqlTx)
+}
+
+func deleteSections(id string, dataType string, sqlTx *gorm.DB) error {
+	return sqlTx.Delete(&DbSections{}, "indexer_id = ? AND data_type = ?", id, dataType).Error
+}
 
-	return err
+func insertSections(section SectionId, sqlTx *gorm.DB) error {
+	return sqlTx.CreateInBatches(convertSectionId(section), 20000).Error
 }
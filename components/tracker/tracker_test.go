@@ -6,7 +6,9 @@ import (
 	"github.com/Zondax/zindexer/components/connections/database/postgres"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -57,7 +59,7 @@ func init() {
 		fmt.Println(tx.Error)
 	}
 
-	err = dbConn.AutoMigrate(DbSection{})
+	err = dbConn.AutoMigrate(DbSection{}, WipLease{})
 	if err != nil {
 		panic(err)
 	}
@@ -156,3 +158,351 @@ func TestTracer_MissingHeights(t *testing.T) {
 		t.Errorf("Missing heights do not match. Wanted: %v, Got: %v", expectedMissing_3, missing)
 	}
 }
+
+func TestTracer_OutdatedVersionMissingHeights(t *testing.T) {
+	// Empty database table
+	dbConn.Exec("DELETE from testing.tracking")
+	defer SetVersionConfig(testingId, VersionConfig{})
+
+	SetVersionConfig(testingId, VersionConfig{Version: 1})
+	err := UpdateTrackedHeights(&[]uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, testingId, dbConn)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// Upgrade the parser and reprocess a few heights
+	SetVersionConfig(testingId, VersionConfig{Version: 2, ReindexPolicy: ReindexOldestFirst})
+	err = UpdateTrackedHeights(&[]uint64{0, 1, 2, 8, 9, 10}, testingId, dbConn)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// The reprocessed heights count as progress
+	progressMutex.Lock()
+	samples := progressStates[testingId].samples
+	progressMutex.Unlock()
+	if len(samples) == 0 || samples[len(samples)-1].count != 6 {
+		t.Errorf("Reprocessed heights are not a progress sample: %v", samples)
+	}
+
+	var expectedMissing = &[]uint64{12, 11, 3, 4, 5, 6, 7}
+	missing, err := GetMissingHeights(tipHeight+3, genesisHeight, NoReturnLimit, testingId, dbConn)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if !reflect.DeepEqual(expectedMissing, missing) {
+		t.Errorf("Missing heights do not match. Wanted: %v, Got: %v", expectedMissing, missing)
+	}
+}
+
+func TestTracer_MissingHeightsMetrics(t *testing.T) {
+	// Empty database table
+	dbConn.Exec("DELETE from testing.tracking")
+	defer SetVersionConfig(testingId, VersionConfig{})
+
+	SetVersionConfig(testingId, VersionConfig{Version: 1})
+	err := UpdateTrackedHeights(&[]uint64{0, 1, 2, 3, 4, 5, 6, 7}, testingId, dbConn)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	SetVersionConfig(testingId, VersionConfig{Version: 2})
+	err = UpdateTrackedHeights(&[]uint64{0, 1, 2}, testingId, dbConn)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// A restarted indexer has no metrics until it reads the stored state
+	progressMutex.Lock()
+	delete(progressStates, testingId)
+	progressMutex.Unlock()
+	getMetrics().trackedHeights.DeleteLabelValues(testingId)
+	getMetrics().sections.DeleteLabelValues(testingId)
+	getMetrics().trackedTip.DeleteLabelValues(testingId)
+
+	_, err = GetMissingHeights(tipHeight, genesisHeight, NoReturnLimit, testingId, dbConn)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	m := getMetrics()
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"tracked heights", testutil.ToFloat64(m.trackedHeights.WithLabelValues(testingId)), 8},
+		{"sections", testutil.ToFloat64(m.sections.WithLabelValues(testingId)), 1},
+		{"tracked tip", testutil.ToFloat64(m.trackedTip.WithLabelValues(testingId)), 7},
+		{"progress tracked heights", testutil.ToFloat64(progressGauges.trackedHeights.WithLabelValues(testingId)), 8},
+		// 8, 9 and 10 are not tracked, 3 to 7 are tracked with an outdated version
+		{"missing heights", testutil.ToFloat64(m.missingHeights.WithLabelValues(testingId)), 8},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s - got: %v, want: %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+type reconcileBlock struct {
+	Height uint64
+}
+
+func (reconcileBlock) TableName() string {
+	return postgres.GetTableName("reconcile_blocks")
+}
+
+func TestTracer_Reconcile(t *testing.T) {
+	// Empty database tables
+	dbConn.Exec("DELETE from testing.tracking")
+	err := dbConn.Migrator().DropTable(reconcileBlock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbConn.AutoMigrate(reconcileBlock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := []reconcileBlock{{1}, {2}, {3}, {3}, {7}, {8}, {12}}
+	if err = dbConn.Create(&blocks).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err = UpdateTrackedHeights(&[]uint64{1, 2, 3, 4, 5, 12}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Reconcile(testingId, ReconcileConfig{
+		Table:        reconcileBlock{}.TableName(),
+		HeightColumn: "height",
+		Repair:       true,
+	}, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(report.TrackedWithoutData, Sections{{4, 5}}) {
+		t.Errorf("got: %v, want: %v", report.TrackedWithoutData, Sections{{4, 5}})
+	}
+
+	if !reflect.DeepEqual(report.DataWithoutTracking, Sections{{7, 8}}) {
+		t.Errorf("got: %v, want: %v", report.DataWithoutTracking, Sections{{7, 8}})
+	}
+
+	heights, err := GetTrackedHeights(testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*heights, []uint64{1, 2, 3, 7, 8, 12}) {
+		t.Errorf("Heights after repair do not match. Got: %v", *heights)
+	}
+}
+
+func TestTracer_WipLeases(t *testing.T) {
+	// Empty database tables
+	dbConn.Exec("DELETE from testing.tracking_wip")
+	defer SetLeaseConfig(testingId, LeaseConfig{})
+
+	SetLeaseConfig(testingId, LeaseConfig{Owner: "instance-a", TTL: time.Hour})
+	err := UpdateInProgressHeight(true, &[]uint64{1, 2, 3, 4}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetLeaseConfig(testingId, LeaseConfig{Owner: "instance-b", TTL: time.Millisecond})
+	err = UpdateInProgressHeight(true, &[]uint64{10, 11}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing a height in the middle of a lease splits it
+	err = UpdateInProgressHeight(false, &[]uint64{2}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	wip, err := GetInProgressSections(testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(wip, Sections{{1, 1}, {3, 4}}) {
+		t.Errorf("In-progress sections do not match. Got: %v", wip)
+	}
+
+	reclaimed, err := ReclaimExpiredLeases(testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != 1 {
+		t.Errorf("Expected 1 lease reclaimed, got %d", reclaimed)
+	}
+
+	err = ClearOwnedInProgress(testingId, "instance-a", dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leases, err := GetLeases(testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 0 {
+		t.Errorf("Expected no leases left, got %v", leases)
+	}
+}
+
+func TestTracer_RangeQueries(t *testing.T) {
+	// Empty database tables
+	dbConn.Exec("DELETE from testing.tracking")
+	defer SetVersionConfig(testingId, VersionConfig{})
+
+	err := UpdateTrackedSections(Sections{{1, 5}, {10, 12}}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contiguous sections tracked with another version
+	SetVersionConfig(testingId, VersionConfig{Version: 1})
+	err = UpdateTrackedSections(Sections{{13, 15}}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracked, err := IsTracked(11, testingId, dbConn)
+	if err != nil || !tracked {
+		t.Errorf("Expected height 11 to be tracked. err: %v", err)
+	}
+
+	tracked, err = IsTracked(6, testingId, dbConn)
+	if err != nil || tracked {
+		t.Errorf("Expected height 6 not to be tracked. err: %v", err)
+	}
+
+	count, err := CountTracked(4, 14, testingId, dbConn)
+	if err != nil || count != 7 {
+		t.Errorf("Expected 7 tracked heights, got %d. err: %v", count, err)
+	}
+
+	sections, err := GetTrackedSections(4, 14, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sections, Sections{{4, 5}, {10, 14}}) {
+		t.Errorf("Tracked sections do not match. Got: %v", sections)
+	}
+
+	gap, err := FirstGap(0, testingId, dbConn)
+	if err != nil || gap != 6 {
+		t.Errorf("Expected first gap at 6, got %d. err: %v", gap, err)
+	}
+
+	gap, err = FirstGap(9, testingId, dbConn)
+	if err != nil || gap != 16 {
+		t.Errorf("Expected first gap at 16, got %d. err: %v", gap, err)
+	}
+
+	coverage, err := CoveragePercent(1, 20, testingId, dbConn)
+	if err != nil || coverage != 55 {
+		t.Errorf("Expected 55%% coverage, got %v. err: %v", coverage, err)
+	}
+}
+
+func TestTracer_IdManagement(t *testing.T) {
+	// Empty database tables
+	dbConn.Exec("DELETE from testing.tracking")
+	otherId := testingId + "_other"
+	copyId := testingId + "_copy"
+
+	err := UpdateTrackedSections(Sections{{1, 10}}, testingId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UpdateTrackedSections(Sections{{5, 20}}, otherId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onlyA, onlyB, err := DiffTrackers(testingId, otherId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(onlyA, Sections{{1, 4}}) || !reflect.DeepEqual(onlyB, Sections{{11, 20}}) {
+		t.Errorf("Diff does not match. Got: %v, %v", onlyA, onlyB)
+	}
+
+	if err = CopyTracker(testingId, copyId, dbConn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copying or renaming into a tracked id fails
+	if err = CopyTracker(testingId, otherId, dbConn); err == nil {
+		t.Errorf("Expected error copying into a tracked id")
+	}
+
+	if err = MergeTrackers(otherId, copyId, dbConn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RenameTracker(copyId, otherId, dbConn); err == nil {
+		t.Errorf("Expected error renaming into a tracked id")
+	}
+
+	if err = RemoveSectionsFromTracker(Sections{{1, 20}}, otherId, dbConn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RenameTracker(copyId, otherId, dbConn); err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := GetSections(otherId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sections, Sections{{1, 20}}) {
+		t.Errorf("Sections do not match. Got: %v", sections)
+	}
+
+	// The renamed id exports the metrics of the one it replaced, which stops exporting them
+	if got := testutil.ToFloat64(getMetrics().trackedHeights.WithLabelValues(otherId)); got != 20 {
+		t.Errorf("Tracked heights metric does not match. Got: %v", got)
+	}
+	if got := GetProgress(otherId).TrackedTip; got != 20 {
+		t.Errorf("Progress tracked tip does not match. Got: %v", got)
+	}
+	if getMetrics().trackedHeights.DeleteLabelValues(copyId) {
+		t.Errorf("Renamed id still exports its metrics")
+	}
+
+	sections, err = GetSections(copyId, dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 0 {
+		t.Errorf("Expected renamed id to be empty. Got: %v", sections)
+	}
+
+	// Renaming an id with nothing tracked fails
+	if err = RenameTracker(copyId, testingId+"_missing", dbConn); err == nil {
+		t.Errorf("Expected error renaming an id with nothing tracked")
+	}
+
+	// An id with heights in progress is not untracked
+	heights := []uint64{30}
+	if err = UpdateInProgressHeight(true, &heights, copyId, dbConn); err != nil {
+		t.Fatal(err)
+	}
+	if err = CopyTracker(testingId, copyId, dbConn); err == nil {
+		t.Errorf("Expected error copying into an id with heights in progress")
+	}
+	dbConn.Exec("DELETE from testing.tracking_wip")
+}
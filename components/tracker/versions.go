@@ -0,0 +1,177 @@
+package tracker
+
+import (
+	"sort"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// ReindexPolicy defines the order in which heights tracked with an outdated version are reprocessed
+type ReindexPolicy int
+
+const (
+	// ReindexNewestFirst reprocesses outdated heights from the highest to the lowest one
+	ReindexNewestFirst ReindexPolicy = iota
+	// ReindexOldestFirst reprocesses outdated heights from the lowest to the highest one
+	ReindexOldestFirst
+)
+
+// VersionConfig defines the parser (or schema) version used by an indexer. Heights tracked with an older
+// version are considered missing, so they get reprocessed after never indexed ones
+type VersionConfig struct {
+	Version       uint64
+	ReindexPolicy ReindexPolicy
+}
+
+// VersionedSections holds the sections tracked by each version
+type VersionedSections = map[uint64]Sections
+
+var (
+	versionMutex   sync.RWMutex
+	versionConfigs = make(map[string]VersionConfig)
+)
+
+// SetVersionConfig sets the current version of id. Heights tracked from now on are recorded with it
+func SetVersionConfig(id string, cfg VersionConfig) {
+	versionMutex.Lock()
+	defer versionMutex.Unlock()
+
+	versionConfigs[id] = cfg
+}
+
+// GetVersionConfig returns the version config of id, version 0 if none was set
+func GetVersionConfig(id string) VersionConfig {
+	versionMutex.RLock()
+	defer versionMutex.RUnlock()
+
+	return versionConfigs[id]
+}
+
+// GetOutdatedSections returns the sections of id tracked with a version older than the current one
+func GetOutdatedSections(id string, db *gorm.DB) (Sections, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	versioned, err := readVersionedDb(id, "", db)
+	if err != nil {
+		return nil, err
+	}
+
+	_, outdated := splitOutdated(versioned, id)
+	return outdated, nil
+}
+
+// splitOutdated returns all the tracked sections, and the ones tracked with a version older than the current one of id
+func splitOutdated(versioned VersionedSections, id string) (all Sections, outdated Sections) {
+	all, upToDate := splitByVersion(versioned, GetVersionConfig(id).Version)
+	return all, RemoveSections(all, upToDate)
+}
+
+// splitByVersion returns all the tracked sections, and the ones tracked with version 'current' or newer
+func splitByVersion(versioned VersionedSections, current uint64) (all Sections, upToDate Sections) {
+	for version, sections := range versioned {
+		all = append(all, sections...)
+		if version >= current {
+			upToDate = append(upToDate, sections...)
+		}
+	}
+
+	return MergeSections(all), MergeSections(upToDate)
+}
+
+// trackVersion adds (sections: Sections) to the ones of version 'current', removing them from any other version
+func trackVersion(versioned VersionedSections, sections Sections, current uint64) {
+	for version, tracked := range versioned {
+		if version == current {
+			continue
+		}
+
+		remaining := RemoveSections(tracked, sections)
+		if len(remaining) == 0 {
+			delete(versioned, version)
+			continue
+		}
+		versioned[version] = remaining
+	}
+
+	versioned[current] = MergeSections(append(versioned[current], sections...))
+}
+
+// untrackVersions removes (toRemove: Sections) from every version
+func untrackVersions(versioned VersionedSections, toRemove Sections) {
+	for version, tracked := range versioned {
+		remaining := RemoveSections(tracked, toRemove)
+		if len(remaining) == 0 {
+			delete(versioned, version)
+			continue
+		}
+		versioned[version] = remaining
+	}
+}
+
+// orderHeights returns at most 'limit' heights of (sections: Sections) in the order defined by policy
+func orderHeights(sections Sections, policy ReindexPolicy, limit uint64) []uint64 {
+	var heights []uint64
+
+	sections = MergeSections(sections)
+	if policy == ReindexOldestFirst {
+		for _, section := range sections {
+			for h := section.StartIdx; h <= section.EndIdx; h++ {
+				if limit != NoReturnLimit && uint64(len(heights)) >= limit {
+					return heights
+				}
+				heights = append(heights, h)
+			}
+		}
+		return heights
+	}
+
+	sort.Slice(sections, func(i, j int) bool {
+		return sections[i].StartIdx > sections[j].StartIdx
+	})
+	for _, section := range sections {
+		for h := section.EndIdx; h >= section.StartIdx; h-- {
+			if limit != NoReturnLimit && uint64(len(heights)) >= limit {
+				return heights
+			}
+			heights = append(heights, h)
+			if h == 0 {
+				break
+			}
+		}
+	}
+
+	return heights
+}
+
+func readVersionedDb(id string, dataType string, db *gorm.DB) (VersionedSections, error) {
+	var dbSections DbSections
+	tx := db.Find(&dbSections, "indexer_id = ? AND data_type = ?", id, dataType)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	versioned := make(VersionedSections)
+	for _, s := range dbSections {
+		versioned[s.Version] = append(versioned[s.Version], s.Section)
+	}
+
+	return versioned, nil
+}
+
+// writeVersionedSections replaces the sections stored for id and dataType. It must be called inside a transaction
+func writeVersionedSections(id string, dataType string, versioned VersionedSections, sqlTx *gorm.DB) error {
+	if err := deleteSections(id, dataType, sqlTx); err != nil {
+		return err
+	}
+
+	for version, sections := range versioned {
+		err := insertSections(SectionId{Sections: MergeSections(sections), IndexerId: id, DataType: dataType, Version: version}, sqlTx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
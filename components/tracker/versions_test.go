@@ -0,0 +1,80 @@
+package tracker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTracker_TrackVersion(t *testing.T) {
+	versioned := VersionedSections{
+		1: Sections{{0, 10}},
+		2: Sections{{11, 20}},
+	}
+
+	trackVersion(versioned, Sections{{5, 15}}, 3)
+
+	want := VersionedSections{
+		1: Sections{{0, 4}},
+		2: Sections{{16, 20}},
+		3: Sections{{5, 15}},
+	}
+	if !reflect.DeepEqual(versioned, want) {
+		t.Errorf("got: %v, want: %v", versioned, want)
+	}
+
+	trackVersion(versioned, Sections{{0, 4}}, 3)
+	if _, ok := versioned[1]; ok {
+		t.Errorf("version 1 should be removed once all its sections are reprocessed, got: %v", versioned)
+	}
+}
+
+func TestTracker_SplitByVersion(t *testing.T) {
+	versioned := VersionedSections{
+		1: Sections{{0, 4}},
+		2: Sections{{5, 10}},
+		3: Sections{{11, 20}},
+	}
+
+	all, upToDate := splitByVersion(versioned, 2)
+
+	if !reflect.DeepEqual(all, Sections{{0, 20}}) {
+		t.Errorf("got: %v, want: %v", all, Sections{{0, 20}})
+	}
+
+	if !reflect.DeepEqual(upToDate, Sections{{5, 20}}) {
+		t.Errorf("got: %v, want: %v", upToDate, Sections{{5, 20}})
+	}
+}
+
+func TestTracker_OrderHeights(t *testing.T) {
+	tests := []struct {
+		sections Sections
+		policy   ReindexPolicy
+		limit    uint64
+		want     []uint64
+	}{
+		{Sections{{0, 2}, {6, 7}}, ReindexOldestFirst, NoReturnLimit, []uint64{0, 1, 2, 6, 7}},
+		{Sections{{0, 2}, {6, 7}}, ReindexNewestFirst, NoReturnLimit, []uint64{7, 6, 2, 1, 0}},
+		{Sections{{0, 2}, {6, 7}}, ReindexOldestFirst, 2, []uint64{0, 1}},
+		{Sections{{0, 2}, {6, 7}}, ReindexNewestFirst, 3, []uint64{7, 6, 2}},
+	}
+
+	for _, tt := range tests {
+		got := orderHeights(tt.sections, tt.policy, tt.limit)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got: %v, want: %v", got, tt.want)
+		}
+	}
+}
+
+func TestTracker_MergeVersions(t *testing.T) {
+	dst := VersionedSections{1: {{0, 10}}}
+	src := VersionedSections{0: {{5, 15}}, 2: {{20, 25}}}
+
+	mergeVersions(dst, src)
+
+	want := VersionedSections{1: {{0, 10}}, 0: {{11, 15}}, 2: {{20, 25}}}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("got: %v, want: %v", dst, want)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/Zondax/zindexer
 go 1.20
 
 require (
+	github.com/ClickHouse/clickhouse-go/v2 v2.8.3
 	github.com/ThreeDotsLabs/watermill v1.1.1
 	github.com/aws/aws-sdk-go v1.35.13
 	github.com/coinbase/rosetta-sdk-go v0.6.10
@@ -10,6 +11,7 @@ require (
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/gorilla/mux v1.8.0
 	github.com/hasura/go-graphql-client v0.9.1
+	github.com/jackc/pgx/v5 v5.5.4
 	github.com/jszwec/csvutil v1.6.0
 	github.com/minio/minio-go/v7 v7.0.49
 	github.com/orcaman/concurrent-map v1.0.0
@@ -27,7 +29,6 @@ require (
 
 require (
 	github.com/ClickHouse/ch-go v0.53.0 // indirect
-	github.com/ClickHouse/clickhouse-go/v2 v2.8.3 // indirect
 	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
@@ -44,7 +45,6 @@ require (
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
-	github.com/jackc/pgx/v5 v5.5.4 // indirect
 	github.com/jackc/puddle/v2 v2.2.1 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
@@ -3,9 +3,13 @@ package indexer
 import (
 	"github.com/Zondax/zindexer/components/connections/data_store"
 	"github.com/Zondax/zindexer/components/db_buffer"
+	"github.com/Zondax/zindexer/components/tracker"
 	"github.com/Zondax/zindexer/components/workQueue"
+	"time"
 )
 
+const DefaultWipLeaseTTL = 10 * time.Minute
+
 type ComponentsCfg struct {
 	DBBufferCfg   db_buffer.Config
 	DispatcherCfg WorkQueue.DispatcherConfig
@@ -14,5 +18,15 @@ type ComponentsCfg struct {
 
 type Config struct {
 	EnableBuffer bool
+	// ParserVersion is recorded along the tracked heights. Heights tracked by an older version are reindexed
+	ParserVersion uint64
+	ReindexPolicy tracker.ReindexPolicy
+	// InstanceId identifies this instance as owner of the in-progress heights it dispatches. Defaults to the hostname
+	InstanceId string
+	// WipLeaseTTL is the time after which in-progress heights not renewed by their owner are dispatched again
+	WipLeaseTTL time.Duration
+	// OrderedStartHeight is the height the ordered syncs of the buffer start from, or the first one not tracked
+	// after it
+	OrderedStartHeight uint64
 	ComponentsCfg
 }
@@ -1,6 +1,8 @@
 package indexer
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/Zondax/zindexer/components/db_buffer"
 	"github.com/Zondax/zindexer/components/tracker"
 	"github.com/Zondax/zindexer/components/workQueue"
@@ -22,26 +24,44 @@ type Indexer struct {
 	missingJobsCB MissingJobsFn
 	Config        Config
 
-	stopReqChan  chan bool
-	stopResChan  chan bool
-	statusServer *StatusServer
+	stopReqChan   chan bool
+	stopResChan   chan bool
+	leaseStopChan chan bool
+	statusServer  *StatusServer
 }
 
 func NewIndexer(dbConn *gorm.DB, id string, cfg Config) *Indexer {
 	checkConfig(&cfg)
+	if cfg.DBBufferCfg.Name == "" {
+		cfg.DBBufferCfg.Name = id
+	}
 
 	dbBuffer := db_buffer.NewDBBuffer(dbConn, cfg.DBBufferCfg)
 	dispatcher := WorkQueue.NewJobDispatcher(cfg.DispatcherCfg)
 
-	return &Indexer{
+	tracker.SetVersionConfig(id, tracker.VersionConfig{
+		Version:       cfg.ParserVersion,
+		ReindexPolicy: cfg.ReindexPolicy,
+	})
+	tracker.SetLeaseConfig(id, tracker.LeaseConfig{
+		Owner: cfg.InstanceId,
+		TTL:   cfg.WipLeaseTTL,
+	})
+
+	i := &Indexer{
 		Id:            id,
 		DbConn:        dbConn,
 		DBBuffer:      dbBuffer,
 		jobDispatcher: dispatcher,
 		Config:        cfg,
 		stopReqChan:   make(chan bool),
-		stopResChan:   make(chan bool),
+		stopResChan:   make(chan bool, 1), // onStop does not block when stopping without StopIndexing
+		leaseStopChan: make(chan bool, 1),
 	}
+
+	dbBuffer.SetRequeueFunc(i.requeueHeights)
+	dbBuffer.SetGapAlertFunc(i.onBufferGap)
+	return i
 }
 
 func checkConfig(cfg *Config) {
@@ -51,6 +71,16 @@ func checkConfig(cfg *Config) {
 		cfg.DBBufferCfg.SyncTimePeriod = db_buffer.DefaultSyncPeriod
 	}
 
+	// in-progress leases
+	if cfg.InstanceId == "" {
+		cfg.InstanceId = defaultInstanceId()
+	}
+
+	if cfg.WipLeaseTTL <= 0 {
+		zap.S().Debugf("Setting default value for WipLeaseTTL: %s", DefaultWipLeaseTTL.String())
+		cfg.WipLeaseTTL = DefaultWipLeaseTTL
+	}
+
 	// dispatcher
 	if cfg.DispatcherCfg.RetryTimeout <= 0 {
 		zap.S().Debugf("Setting default value for Dispatcher's DefaultRetryTimeout: %s", WorkQueue.DefaultRetryTimeout.String())
@@ -58,6 +88,28 @@ func checkConfig(cfg *Config) {
 	}
 }
 
+// defaultInstanceId returns the hostname, or a random id if it is not available, so instances never share
+// the owner of their leases. A random id changes on restart: the leases of the previous run expire instead of
+// being cleared
+func defaultInstanceId() string {
+	hostname, err := os.Hostname()
+	if err == nil && hostname != "" {
+		zap.S().Debugf("Setting default value for InstanceId: %s", hostname)
+		return hostname
+	}
+
+	id := make([]byte, 8)
+	if _, randErr := rand.Read(id); randErr != nil {
+		zap.S().Errorf("could not get hostname (%v) nor a random id to use as InstanceId: %v", err, randErr)
+		panic(randErr)
+	}
+
+	instanceId := "instance-" + hex.EncodeToString(id)
+	zap.S().Warnf("could not get hostname to use as InstanceId (%v), using random id %s. Set InstanceId so "+
+		"the leases of a previous run are cleared on start", err, instanceId)
+	return instanceId
+}
+
 func (i *Indexer) SetWorkerConstructor(w WorkQueue.WorkerConstructor) {
 	if w == nil {
 		zap.S().Errorf("worker constructor cannot be nil")
@@ -74,6 +126,18 @@ func (i *Indexer) SetSyncCB(cb db_buffer.SyncCB) {
 	i.DBBuffer.SetSyncFunc(cb)
 }
 
+func (i *Indexer) SetKeySyncCB(key string, cb db_buffer.SyncCB, cfg db_buffer.KeyConfig) {
+	i.DBBuffer.SetKeySyncFunc(key, cb, cfg)
+}
+
+func (i *Indexer) SetTxSyncCB(cb db_buffer.TxSyncCB) {
+	i.DBBuffer.SetTxSyncFunc(cb)
+}
+
+func (i *Indexer) SetKeyTxSyncCB(key string, cb db_buffer.TxSyncCB, cfg db_buffer.KeyConfig) {
+	i.DBBuffer.SetKeyTxSyncFunc(key, cb, cfg)
+}
+
 func (i *Indexer) SetGetMissingHeightsFn(fn MissingJobsFn) {
 	i.missingJobsCB = fn
 }
@@ -83,19 +147,26 @@ func (i *Indexer) EnqueueJob(work WorkQueue.Job) {
 }
 
 func (i *Indexer) StartIndexing() {
-	// Clear all in-progress jobs of previous run
-	err := tracker.ClearInProgress(i.Id, i.DbConn)
+	// Clear the in-progress jobs this instance owned on its previous run. The ones of other
+	// instances are reclaimed once their leases expire
+	err := tracker.ClearOwnedInProgress(i.Id, i.Config.InstanceId, i.DbConn)
 	if err != nil {
 		zap.S().Error(err)
 		panic(err)
 	}
+	go i.keepLeases()
 
 	exitChan := make(chan os.Signal, 1)
 	signal.Notify(exitChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Start db_buffer
 	if i.Config.EnableBuffer {
-		i.DBBuffer.Start()
+		i.replayBufferWal()
+		i.setBufferNextHeight()
+		if err := i.DBBuffer.Start(); err != nil {
+			zap.S().Error(err)
+			panic(err)
+		}
 	}
 
 	// Start job dispatcher
@@ -114,6 +185,10 @@ func (i *Indexer) StartIndexing() {
 			zap.S().Debugf("Exit signal catched!")
 			i.onStop()
 			return
+		case err := <-i.DBBuffer.Halted:
+			zap.S().Errorf("DB buffer halted, stopping: %v", err)
+			i.onStop()
+			return
 		case <-i.stopReqChan:
 			zap.S().Debugf("Stop signal received!")
 			i.onStop()
@@ -124,6 +199,68 @@ func (i *Indexer) StartIndexing() {
 	}
 }
 
+// replayBufferWal loads the data buffered before a crash, and marks its heights as in progress again
+// so they are not dispatched before being synced
+func (i *Indexer) replayBufferWal() {
+	if i.Config.DBBufferCfg.WalDir == "" {
+		return
+	}
+
+	heights, err := i.DBBuffer.ReplayWAL()
+	if err != nil {
+		zap.S().Error(err)
+		panic(err)
+	}
+
+	if len(heights) == 0 {
+		return
+	}
+
+	err = tracker.UpdateInProgressHeight(true, &heights, i.Id, i.DbConn)
+	if err != nil {
+		zap.S().Error(err)
+		panic(err)
+	}
+}
+
+// setBufferNextHeight starts the ordered syncs of the buffer at the lowest height not tracked from
+// OrderedStartHeight on. Untracked heights below it are synced out of order by the buffer
+func (i *Indexer) setBufferNextHeight() {
+	if !i.Config.DBBufferCfg.Ordered {
+		return
+	}
+
+	next := i.Config.OrderedStartHeight
+	tracked, err := tracker.IsTracked(next, i.Id, i.DbConn)
+	if err == nil && tracked {
+		next, err = tracker.FirstGap(next, i.Id, i.DbConn)
+	}
+	if err != nil {
+		zap.S().Error(err)
+		panic(err)
+	}
+
+	i.DBBuffer.SetNextHeight(int64(next))
+}
+
+// onBufferGap moves the ordered syncs past a gap which is already tracked, as heights tracked before
+// are not synced again
+func (i *Indexer) onBufferGap(keys string, height int64, since time.Time) {
+	tracked, err := tracker.IsTracked(uint64(height), i.Id, i.DbConn)
+	if err != nil || !tracked {
+		return
+	}
+
+	next, err := tracker.FirstGap(uint64(height), i.Id, i.DbConn)
+	if err != nil {
+		zap.S().Errorf("[Indexer] - could not find the end of the buffer gap at height %d: %v", height, err)
+		return
+	}
+
+	zap.S().Warnf("[Indexer] - buffer gap of %s at height %d is already tracked, resuming ordered syncs at %d", keys, height, next)
+	i.DBBuffer.SetNextHeight(int64(next))
+}
+
 func (i *Indexer) addPendingHeights(jobs []WorkQueue.Job) error {
 	pendingJobHeights := make([]uint64, len(jobs))
 	for i, j := range jobs {
@@ -141,6 +278,15 @@ func (i *Indexer) addPendingHeights(jobs []WorkQueue.Job) error {
 	return nil
 }
 
+// requeueHeights releases the in-progress leases of the heights whose data failed to sync, or was dropped,
+// so missingJobsCB builds their jobs again, with their params, once the job queue is empty
+func (i *Indexer) requeueHeights(heights []uint64) {
+	zap.S().Infof("Re-enqueuing %d heights which were not synced", len(heights))
+	if err := tracker.UpdateInProgressHeight(false, &heights, i.Id, i.DbConn); err != nil {
+		zap.S().Errorf("[Indexer] - could not release the heights which were not synced: %v", err)
+	}
+}
+
 func (i *Indexer) onJobQueueEmpty() {
 	pendingJobs, err := i.missingJobsCB()
 	if err != nil {
@@ -160,6 +306,26 @@ func (i *Indexer) onJobQueueEmpty() {
 	}
 }
 
+// GetProgress returns the indexing progress of this indexer: tracked heights, rate, lag and ETA
+func (i *Indexer) GetProgress() tracker.Progress {
+	return tracker.GetProgress(i.Id)
+}
+
+// GetStatus returns the status reported by the status server
+func (i *Indexer) GetStatus() IndexerStatus {
+	status := IndexerStatus{
+		Id:       i.Id,
+		Progress: i.GetProgress(),
+	}
+
+	if i.Config.EnableBuffer {
+		bufferStatus := i.DBBuffer.GetStatus()
+		status.Buffer = &bufferStatus
+	}
+
+	return status
+}
+
 func (i *Indexer) StopIndexing() {
 	zap.S().Info("[Indexer] - StopIndexing START")
 	i.stopReqChan <- true
@@ -167,10 +333,35 @@ func (i *Indexer) StopIndexing() {
 	zap.S().Info("[Indexer] - StopIndexing END")
 }
 
+// keepLeases renews the in-progress leases owned by this instance and reclaims the expired ones of any instance
+func (i *Indexer) keepLeases() {
+	ticker := time.NewTicker(i.Config.WipLeaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		if _, err := tracker.ReclaimExpiredLeases(i.Id, i.DbConn); err != nil {
+			zap.S().Errorf("[Indexer] - could not reclaim expired leases: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+			if err := tracker.RenewLeases(i.Id, i.Config.InstanceId, i.Config.WipLeaseTTL, i.DbConn); err != nil {
+				zap.S().Errorf("[Indexer] - could not renew leases: %v", err)
+			}
+		case <-i.leaseStopChan:
+			return
+		}
+	}
+}
+
 func (i *Indexer) onStop() {
 	zap.S().Info("[Indexer]- graceful shutdown requested!")
+	i.leaseStopChan <- true
 	i.jobDispatcher.Stop()
-	i.DBBuffer.Stop()
+	// with FlushOnStop, the data of the finished jobs is synced before exiting
+	if err := i.DBBuffer.Stop(); err != nil {
+		zap.S().Errorf("[Indexer]- buffer flush failed, its heights will be fetched again: %v", err)
+	}
 	i.stopResChan <- true
 	zap.S().Info("[Indexer]- graceful shutdown done!")
 }
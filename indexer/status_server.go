@@ -2,6 +2,9 @@ package indexer
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/Zondax/zindexer/components/db_buffer"
+	"github.com/Zondax/zindexer/components/tracker"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"go.uber.org/zap"
@@ -13,6 +16,13 @@ type StatusServer struct {
 	server *http.Server
 }
 
+// IndexerStatus is the response of the status server's '/status' endpoint
+type IndexerStatus struct {
+	Id       string            `json:"id"`
+	Progress tracker.Progress  `json:"progress"`
+	Buffer   *db_buffer.Status `json:"buffer,omitempty"`
+}
+
 func NewStatusServer(i *Indexer) *StatusServer {
 	r := chi.NewRouter()
 	s := &http.Server{Addr: ":3300", ReadHeaderTimeout: 5 * time.Second, Handler: r}
@@ -23,6 +33,13 @@ func NewStatusServer(i *Indexer) *StatusServer {
 		i.StopIndexing()
 		w.WriteHeader(http.StatusOK)
 	})
+	r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(i.GetStatus())
+		if err != nil {
+			zap.S().Errorf("StatusServer: %s", err.Error())
+		}
+	})
 
 	return &StatusServer{server: s}
 }
@@ -3,7 +3,9 @@ package tests
 import (
 	"fmt"
 	"github.com/Zondax/zindexer"
+	"github.com/Zondax/zindexer/components/db_buffer"
 	"github.com/Zondax/zindexer/components/tracker"
+	"github.com/Zondax/zindexer/indexer"
 	"github.com/Zondax/zindexer/indexer/tests/utils"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -23,8 +25,9 @@ func TestMain(m *testing.M) {
 func setupTestingDB(db *gorm.DB) {
 	err := db.Transaction(func(sqlTx *gorm.DB) error {
 		sqlTx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tracker.DbSection{}.TableName()))
+		sqlTx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tracker.WipLease{}.TableName()))
 		sqlTx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", DummyBlock{}.TableName()))
-		err := sqlTx.AutoMigrate(tracker.DbSection{}, DummyBlock{})
+		err := sqlTx.AutoMigrate(tracker.DbSection{}, tracker.WipLease{}, DummyBlock{})
 		if err != nil {
 			return err
 		}
@@ -164,3 +167,112 @@ func TestBasicIndexerWithExitMultiWorkers(t *testing.T) {
 		t.Error("indexer did not stop properly!")
 	}
 }
+
+func TestTypedBufferSync(t *testing.T) {
+	dbConn := utils.InitdbConn()
+	setupTestingDB(dbConn)
+
+	config := indexer.Config{
+		EnableBuffer: true,
+		ComponentsCfg: indexer.ComponentsCfg{
+			DBBufferCfg: db_buffer.Config{
+				SyncTimePeriod:     MockSyncTimePeriod,
+				SyncBlockThreshold: MockSyncBlockPeriod,
+			},
+		},
+	}
+	baseIndexer := indexer.NewIndexer(dbConn, MockId, config)
+	dummyBuffer, err := db_buffer.RegisterTypedBuffer[DummyBlock](baseIndexer.DBBuffer, "dummy")
+	if err != nil {
+		panic(err)
+	}
+
+	synced := make(chan []uint64, 1)
+	baseIndexer.SetSyncCB(func() db_buffer.SyncResult {
+		blocks, heights, err := dummyBuffer.GetItems()
+		if err == nil && len(blocks) > 0 {
+			err = dbConn.Create(blocks).Error
+		}
+		synced <- heights
+		return db_buffer.SyncResult{Id: MockId, SyncedHeights: &heights, Error: err}
+	})
+
+	if err = baseIndexer.DBBuffer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer baseIndexer.DBBuffer.Stop()
+
+	for h := MockSyncBlockPeriod - 1; h >= 0; h-- {
+		block := DummyBlock{Height: uint64(h), Hash: utils.NewSHA256Hash()}
+		if err = dummyBuffer.InsertData(int64(h), []DummyBlock{block}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the heights are synced in ascending order
+	heights := <-synced
+	for i, h := range heights {
+		if h != uint64(i) {
+			t.Errorf("synced heights are not sorted: %v", heights)
+			break
+		}
+	}
+
+	var count int64
+	if err = dbConn.Model(&DummyBlock{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != MockSyncBlockPeriod {
+		t.Errorf("synced blocks - got: %d, want: %d", count, MockSyncBlockPeriod)
+	}
+}
+
+func TestOrderedStaleHeightIsTracked(t *testing.T) {
+	dbConn := utils.InitdbConn()
+	setupTestingDB(dbConn)
+
+	config := indexer.Config{
+		EnableBuffer: true,
+		ComponentsCfg: indexer.ComponentsCfg{
+			DBBufferCfg: db_buffer.Config{
+				SyncTimePeriod:     MockSyncTimePeriod,
+				SyncBlockThreshold: MockSyncBlockPeriod,
+				Ordered:            true,
+			},
+		},
+	}
+	baseIndexer := indexer.NewIndexer(dbConn, MockId, config)
+	dummyBuffer, err := db_buffer.RegisterTypedBuffer[DummyBlock](baseIndexer.DBBuffer, "dummy")
+	if err != nil {
+		panic(err)
+	}
+
+	baseIndexer.SetSyncCB(func() db_buffer.SyncResult {
+		_, heights, err := dummyBuffer.GetItems()
+		return db_buffer.SyncResult{Id: MockId, SyncedHeights: &heights, Error: err}
+	})
+
+	baseIndexer.DBBuffer.SetNextHeight(10)
+	if err = baseIndexer.DBBuffer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer baseIndexer.DBBuffer.Stop()
+
+	// The data of the height arrives once the ordered syncs are past it, it is synced out of order
+	if err = dummyBuffer.InsertData(5, []DummyBlock{{Height: 5}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * MockSyncTimePeriod)
+	for time.Now().Before(deadline) {
+		tracked, err := tracker.IsTracked(5, MockId, dbConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tracked {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("stale height is not tracked")
+}
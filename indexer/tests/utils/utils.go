@@ -46,7 +46,7 @@ func InitdbConn() *gorm.DB {
 		panic(err)
 	}
 
-	err = dbConn.AutoMigrate(tracker.DbSection{})
+	err = dbConn.AutoMigrate(tracker.DbSection{}, tracker.WipLease{})
 	if err != nil {
 		panic(err)
 	}